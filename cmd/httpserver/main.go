@@ -1,45 +1,48 @@
 package main
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"httpfromtcp/internal/client"
 	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/middleware"
 	"httpfromtcp/internal/request"
 	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/router"
 	"httpfromtcp/internal/server"
 	"io"
 	"log"
-	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 )
 
 const port = 42069
 
-func handler(w *response.Writer, req *request.Request) {
-	target := req.RequestLine.RequestTarget
-
-	// Check if this is a proxy request
-	if strings.HasPrefix(target, "/httpbin") {
-		handleProxy(w, target)
-		return
-	}
-
-	// Handle video endpoint
-	if target == "/video" {
-		handleVideo(w)
-		return
-	}
-
-	var statusCode response.StatusCode
-	var htmlBody string
+// shutdownTimeout bounds how long in-flight requests get to finish after a
+// stop signal.
+const shutdownTimeout = 10 * time.Second
+
+// proxyClient sends the requests handleProxy forwards to httpbin.org.
+var proxyClient = client.New(client.Config{Timeout: 30 * time.Second})
+
+// hopHeaders are the response header fields handleProxy doesn't forward,
+// they describe the connection to httpbin.org or the framing of a body
+// that is sent chunked instead.
+var hopHeaders = map[string]bool{
+	"Connection":        true,
+	"Keep-Alive":        true,
+	"Content-Length":    true,
+	"Transfer-Encoding": true,
+	"Trailer":           true,
+}
 
-	if target == "/yourproblem" {
-		statusCode = response.StatusBadRequest
-		htmlBody = `<html>
+const yourProblemHTML = `<html>
   <head>
     <title>400 Bad Request</title>
   </head>
@@ -48,9 +51,8 @@ func handler(w *response.Writer, req *request.Request) {
     <p>Your request honestly kinda sucked.</p>
   </body>
 </html>`
-	} else if target == "/myproblem" {
-		statusCode = response.StatusInternalServerError
-		htmlBody = `<html>
+
+const myProblemHTML = `<html>
   <head>
     <title>500 Internal Server Error</title>
   </head>
@@ -59,9 +61,8 @@ func handler(w *response.Writer, req *request.Request) {
     <p>Okay, you know what? This one is on me.</p>
   </body>
 </html>`
-	} else {
-		statusCode = response.StatusOK
-		htmlBody = `<html>
+
+const successHTML = `<html>
   <head>
     <title>200 OK</title>
   </head>
@@ -70,43 +71,47 @@ func handler(w *response.Writer, req *request.Request) {
     <p>Your request was an absolute banger.</p>
   </body>
 </html>`
-	}
 
-	// Write status line
-	err := w.WriteStatusLine(statusCode)
-	if err != nil {
-		return
-	}
+func newRouter() *router.Router {
+	r := router.New()
+	r.Mount("/httpbin", handleProxy)
+	r.Get("/video", handleVideo)
+	r.Handle("", "/yourproblem", htmlHandler(response.StatusBadRequest, yourProblemHTML))
+	r.Handle("", "/myproblem", htmlHandler(response.StatusInternalServerError, myProblemHTML))
+	r.Handle("", "/{path...}", htmlHandler(response.StatusOK, successHTML))
+	return r
+}
 
-	// Create headers with Content-Type set to text/html
-	headers := headers.NewHeaders()
-	headers.Set("Content-Length", fmt.Sprintf("%d", len(htmlBody)))
-	headers.Set("Connection", "close")
-	headers.SetOverride("Content-Type", "text/html")
+func htmlHandler(statusCode response.StatusCode, htmlBody string) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		// Set Content-Type to text/html, the writer adds the Content-Length
+		w.Header().Set("Content-Type", "text/html")
 
-	// Write headers
-	err = w.WriteHeaders(headers)
-	if err != nil {
-		return
+		// Write status line and headers
+		err := w.WriteHeader(statusCode)
+		if err != nil {
+			return
+		}
+
+		// Write body
+		_, err = io.WriteString(w, htmlBody)
+		if err != nil {
+			return
+		}
 	}
+}
 
-	// Write body
-	_, err = w.WriteBody([]byte(htmlBody))
+func handleVideo(w *response.Writer, req *request.Request) {
+	// Open the video file
+	video, err := os.Open("assets/vim.mp4")
 	if err != nil {
+		writeVideoError(w, err)
 		return
 	}
-}
-
-func handleVideo(w *response.Writer) {
-	// Read the video file
-	videoData, err := os.ReadFile("assets/vim.mp4")
+	defer video.Close()
+	info, err := video.Stat()
 	if err != nil {
-		// Write error response
-		w.WriteStatusLine(response.StatusInternalServerError)
-		errorHeaders := headers.NewHeaders()
-		errorHeaders.Set("Connection", "close")
-		w.WriteHeaders(errorHeaders)
-		w.WriteBody([]byte("Error reading video file: " + err.Error()))
+		writeVideoError(w, err)
 		return
 	}
 
@@ -118,9 +123,8 @@ func handleVideo(w *response.Writer) {
 
 	// Create headers with Content-Type set to video/mp4
 	videoHeaders := headers.NewHeaders()
-	videoHeaders.Set("Content-Length", fmt.Sprintf("%d", len(videoData)))
-	videoHeaders.Set("Connection", "close")
-	videoHeaders.SetOverride("Content-Type", "video/mp4")
+	videoHeaders.SetContentLength(info.Size())
+	videoHeaders.Set("Content-Type", "video/mp4")
 
 	// Write headers
 	err = w.WriteHeaders(videoHeaders)
@@ -128,123 +132,107 @@ func handleVideo(w *response.Writer) {
 		return
 	}
 
-	// Write body
-	_, err = w.WriteBody(videoData)
+	// Copy the file into the body without reading it all in memory
+	_, err = io.Copy(w, video)
 	if err != nil {
 		return
 	}
 }
 
-func handleProxy(w *response.Writer, target string) {
-	// Extract the path after /httpbin
-	path := strings.TrimPrefix(target, "/httpbin")
-	if path == "" {
-		path = "/"
+func writeVideoError(w *response.Writer, err error) {
+	w.WriteStatusLine(response.StatusInternalServerError)
+	w.WriteHeaders(headers.NewHeaders())
+	w.WriteBody([]byte("Error reading video file: " + err.Error()))
+}
+
+func handleProxy(w *response.Writer, req *request.Request) {
+	// Extract the path after /httpbin, keeping the query
+	path := req.PathValue(router.MountPathKey)
+	if _, query, ok := strings.Cut(req.RequestLine.RequestTarget, "?"); ok {
+		path += "?" + query
 	}
 
 	// Make request to httpbin.org
 	url := "https://httpbin.org" + path
-	resp, err := http.Get(url)
+	resp, err := proxyClient.Get(url)
 	if err != nil {
 		// Write error response
 		w.WriteStatusLine(response.StatusInternalServerError)
-		errorHeaders := headers.NewHeaders()
-		errorHeaders.Set("Connection", "close")
-		w.WriteHeaders(errorHeaders)
+		w.WriteHeaders(headers.NewHeaders())
 		w.WriteBody([]byte("Proxy error: " + err.Error()))
 		return
 	}
-	defer resp.Body.Close()
-
-	// Convert HTTP status code to our StatusCode type
-	statusCode := response.StatusCode(resp.StatusCode)
+	defer resp.BodyReader.Close()
 
-	// Write status line
-	err = w.WriteStatusLine(statusCode)
-	if err != nil {
-		return
-	}
-
-	// Copy headers from httpbin response, but remove Content-Length and add Transfer-Encoding: chunked
-	proxyHeaders := headers.NewHeaders()
-	for key, values := range resp.Header {
-		lowerKey := strings.ToLower(key)
-		// Skip Content-Length header
-		if lowerKey == "content-length" {
+	// Copy headers from httpbin response, but leave out those about the
+	// connection and the framing, the body is sent chunked
+	for key, value := range resp.Headers.All() {
+		if hopHeaders[key] {
 			continue
 		}
-		// Copy all other headers
-		for _, value := range values {
-			proxyHeaders.Set(key, value)
-		}
+		w.Header().Add(key, value)
 	}
 
-	// Add Transfer-Encoding: chunked
-	proxyHeaders.SetOverride("Transfer-Encoding", "chunked")
-	// Announce trailers
-	proxyHeaders.Set("Trailer", "X-Content-SHA256, X-Content-Length")
-	proxyHeaders.Set("Connection", "close")
-
-	// Write headers
-	err = w.WriteHeaders(proxyHeaders)
+	// Announce trailers computed once the whole body went through
+	body, err := w.ChunkedBody()
 	if err != nil {
 		return
 	}
-
-	// Read response body in chunks, track full body, and forward them
-	buffer := make([]byte, 1024)
-	var fullBody []byte
-	for {
-		n, err := resp.Body.Read(buffer)
-		if n > 0 {
-			// Track the full body
-			fullBody = append(fullBody, buffer[:n]...)
-			// Write chunk
-			_, writeErr := w.WriteChunkedBody(buffer[:n])
-			if writeErr != nil {
-				return
-			}
-		}
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return
-		}
-	}
-
-	// Write final chunk marker
-	_, err = w.WriteChunkedBodyDone()
+	hash := sha256.New()
+	var length int64
+	body.Trailer("X-Content-SHA256", func() string {
+		return hex.EncodeToString(hash.Sum(nil))
+	})
+	body.Trailer("X-Content-Length", func() string {
+		return strconv.FormatInt(length, 10)
+	})
+
+	// Write status line and headers
+	err = w.WriteHeader(resp.StatusLine.StatusCode)
 	if err != nil {
 		return
 	}
 
-	// Calculate SHA256 hash of the full body
-	hash := sha256.Sum256(fullBody)
-	hashHex := hex.EncodeToString(hash[:])
-
-	// Create trailers
-	trailers := headers.NewHeaders()
-	trailers.Set("X-Content-SHA256", hashHex)
-	trailers.Set("X-Content-Length", fmt.Sprintf("%d", len(fullBody)))
-
-	// Write trailers
-	err = w.WriteTrailers(trailers)
+	// Forward the body while hashing it, then end it with the trailers
+	length, err = io.Copy(io.MultiWriter(body, hash), resp.BodyReader)
 	if err != nil {
 		return
 	}
+	body.Close()
 }
 
 func main() {
-	server, err := server.Serve(port, handler)
-	if err != nil {
-		log.Fatalf("Error starting server: %v", err)
-	}
-	defer server.Close()
+	srv := server.New(server.Config{
+		Addr: fmt.Sprintf(":%d", port),
+		Handler: server.Chain(newRouter().ServeRequest,
+			middleware.Recover(nil),
+			middleware.RequestID(),
+			middleware.AccessLog(nil),
+		),
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+		ServerHeader:      "httpfromtcp",
+	})
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.ListenAndServe()
+	}()
 	log.Println("Server started on port", port)
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
+	select {
+	case err := <-serveErr:
+		log.Fatalf("Error starting server: %v", err)
+	case <-sigChan:
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Error stopping server: %v", err)
+		return
+	}
 	log.Println("Server gracefully stopped")
 }
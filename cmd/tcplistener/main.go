@@ -51,7 +51,7 @@ func main() {
 		fmt.Printf("- Target: %s\n", req.RequestLine.RequestTarget)
 		fmt.Printf("- Version: %s\n", req.RequestLine.HttpVersion)
 		fmt.Println("Headers:")
-		for key, value := range req.Headers {
+		for key, value := range req.Headers.All() {
 			fmt.Printf("- %s: %s\n", key, value)
 		}
 		fmt.Println("Body:")
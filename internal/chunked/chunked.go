@@ -0,0 +1,170 @@
+package chunked
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"httpfromtcp/internal/headers"
+)
+
+const crlf = "\r\n"
+
+// Limits on the lines of a chunked body, which are otherwise buffered until
+// their CRLF arrives.
+const (
+	maxLineLength   = 4 << 10
+	maxTrailerBytes = 64 << 10
+)
+
+var (
+	ErrMalformedChunk = errors.New("malformed chunk")
+	ErrLineTooLong    = errors.New("chunk line too long")
+	ErrTrailerTooLong = errors.New("trailer section too large")
+)
+
+type decoderState int
+
+const (
+	decoderStateSize decoderState = iota
+	decoderStateData
+	decoderStateDataEnd
+	decoderStateTrailers
+	decoderStateDone
+)
+
+// Decoder decodes a body in the chunked transfer coding. Like
+// headers.Headers.Parse, it is fed whatever data is available and consumes
+// it one piece at a time.
+type Decoder struct {
+	state        decoderState
+	remaining    uint64
+	trailers     *headers.Headers
+	trailerBytes int
+}
+
+func NewDecoder() *Decoder {
+	return &Decoder{
+		state:    decoderStateSize,
+		trailers: headers.NewHeaders(),
+	}
+}
+
+// Parse consumes the next piece of the chunked body at the start of data:
+// a chunk-size line, chunk data, the CRLF ending a chunk or a trailer line.
+// It returns the number of bytes consumed and, for chunk data, the decoded
+// bytes, which alias data. n is 0 when more data is needed.
+func (d *Decoder) Parse(data []byte) (n int, chunk []byte, err error) {
+	switch d.state {
+	case decoderStateSize:
+		line, n, err := readLine(data)
+		if err != nil || n == 0 {
+			return 0, nil, err
+		}
+		size, err := parseChunkSize(line)
+		if err != nil {
+			return 0, nil, err
+		}
+		d.remaining = size
+		if size == 0 {
+			d.state = decoderStateTrailers
+		} else {
+			d.state = decoderStateData
+		}
+		return n, nil, nil
+	case decoderStateData:
+		if len(data) == 0 {
+			return 0, nil, nil
+		}
+		n := len(data)
+		if uint64(n) > d.remaining {
+			n = int(d.remaining)
+		}
+		d.remaining -= uint64(n)
+		if d.remaining == 0 {
+			d.state = decoderStateDataEnd
+		}
+		return n, data[:n], nil
+	case decoderStateDataEnd:
+		if len(data) < len(crlf) {
+			return 0, nil, nil
+		}
+		if !bytes.HasPrefix(data, []byte(crlf)) {
+			return 0, nil, fmt.Errorf("%w: missing CRLF after chunk data", ErrMalformedChunk)
+		}
+		d.state = decoderStateSize
+		return len(crlf), nil, nil
+	case decoderStateTrailers:
+		n, done, err := d.trailers.Parse(data)
+		if err != nil {
+			return 0, nil, err
+		}
+		if n == 0 {
+			if d.trailerBytes+len(data) > maxTrailerBytes {
+				return 0, nil, ErrTrailerTooLong
+			}
+			return 0, nil, nil
+		}
+		d.trailerBytes += n
+		if d.trailerBytes > maxTrailerBytes {
+			return 0, nil, ErrTrailerTooLong
+		}
+		if done {
+			d.state = decoderStateDone
+		}
+		return n, nil, nil
+	case decoderStateDone:
+		return 0, nil, errors.New("error: trying to read data in a done state")
+	default:
+		return 0, nil, errors.New("unknown state")
+	}
+}
+
+// Done reports whether the last chunk and the trailer section have been
+// parsed.
+func (d *Decoder) Done() bool {
+	return d.state == decoderStateDone
+}
+
+// Trailers returns the trailer fields parsed so far.
+func (d *Decoder) Trailers() *headers.Headers {
+	return d.trailers
+}
+
+// readLine returns the line at the start of data without its CRLF, and the
+// number of bytes it takes up including the CRLF. n is 0 if the line isn't
+// complete yet.
+func readLine(data []byte) (line []byte, n int, err error) {
+	idx := bytes.Index(data, []byte(crlf))
+	if idx == -1 {
+		if len(data) > maxLineLength {
+			return nil, 0, ErrLineTooLong
+		}
+		return nil, 0, nil
+	}
+	if idx > maxLineLength {
+		return nil, 0, ErrLineTooLong
+	}
+	return data[:idx], idx + len(crlf), nil
+}
+
+// parseChunkSize parses a chunk-size line, a hex size optionally followed by
+// chunk extensions, which are validated and ignored.
+func parseChunkSize(line []byte) (uint64, error) {
+	sizeText, extensions, _ := bytes.Cut(line, []byte(";"))
+	sizeText = bytes.TrimRight(sizeText, " \t")
+	if len(sizeText) == 0 {
+		return 0, fmt.Errorf("%w: missing chunk size", ErrMalformedChunk)
+	}
+	size, err := strconv.ParseUint(string(sizeText), 16, 63)
+	if err != nil {
+		return 0, fmt.Errorf("%w: invalid chunk size: %q", ErrMalformedChunk, sizeText)
+	}
+	for _, c := range extensions {
+		if c != '\t' && (c < ' ' || c == 0x7f) {
+			return 0, fmt.Errorf("%w: invalid character in chunk extension", ErrMalformedChunk)
+		}
+	}
+	return size, nil
+}
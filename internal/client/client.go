@@ -0,0 +1,423 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/stream"
+)
+
+// Defaults used for the zero values of Config.
+const (
+	defaultDialTimeout         = 30 * time.Second
+	defaultIdleTimeout         = 90 * time.Second
+	defaultMaxIdleConnsPerHost = 2
+)
+
+// writeBufferSize is the size of the buffer requests are written through.
+const writeBufferSize = 4 << 10
+
+// maxDiscardBytes bounds how much of a response body closed before its end
+// is skipped to keep the connection, past it the connection is closed.
+const maxDiscardBytes = 256 << 10
+
+var ErrUnsupportedScheme = errors.New("unsupported URL scheme")
+
+// Config configures a Client. Zero values select the defaults.
+type Config struct {
+	// DialTimeout bounds opening a connection, TLS handshake included.
+	// Thirty seconds when zero.
+	DialTimeout time.Duration
+	// Timeout bounds a whole exchange, from sending the request to reading
+	// the end of the response body. Zero means no timeout.
+	Timeout time.Duration
+	// ResponseHeaderTimeout bounds waiting for the response's status line
+	// and headers once the request is sent. Zero means only Timeout
+	// applies.
+	ResponseHeaderTimeout time.Duration
+	// IdleTimeout bounds how long a connection waits in the pool for the
+	// next request to its host. Ninety seconds when zero.
+	IdleTimeout time.Duration
+	// MaxIdleConnsPerHost bounds the connections kept in the pool for each
+	// host. Two when zero.
+	MaxIdleConnsPerHost int
+	// TLSConfig is used for https URLs. The server name is set from the
+	// URL when empty.
+	TLSConfig *tls.Config
+}
+
+// Client sends requests over HTTP/1.1, keeping connections open between
+// requests to the same host. It is safe for concurrent use.
+type Client struct {
+	config Config
+
+	mu   sync.Mutex
+	idle map[string][]*conn
+}
+
+// conn is a connection to a host, along with the reader keeping what was
+// read past the last response.
+type conn struct {
+	net.Conn
+	key       string
+	reader    *response.Reader
+	out       *bufio.Writer
+	idleSince time.Time
+}
+
+func New(config Config) *Client {
+	if config.DialTimeout == 0 {
+		config.DialTimeout = defaultDialTimeout
+	}
+	if config.IdleTimeout == 0 {
+		config.IdleTimeout = defaultIdleTimeout
+	}
+	if config.MaxIdleConnsPerHost == 0 {
+		config.MaxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	}
+	return &Client{
+		config: config,
+		idle:   make(map[string][]*conn),
+	}
+}
+
+// DefaultClient is the Client used by Get.
+var DefaultClient = New(Config{})
+
+// Get sends a GET request for rawURL with DefaultClient.
+func Get(rawURL string) (*response.Response, error) {
+	return DefaultClient.Get(rawURL)
+}
+
+// Request is a request to send with a Client.
+type Request struct {
+	Method  string
+	URL     *url.URL
+	Headers *headers.Headers
+	// Body is sent with the request when not nil.
+	Body io.Reader
+	// ContentLength is the length of Body, or -1 if it's unknown, in which
+	// case the body is sent chunked.
+	ContentLength int64
+}
+
+// NewRequest returns a request for rawURL, which must be an http or https
+// URL. The ContentLength of a body held in a bytes.Buffer, bytes.Reader or
+// strings.Reader is set from it, other bodies are sent chunked.
+func NewRequest(method, rawURL string, body io.Reader) (*Request, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedScheme, u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("missing host in URL %q", rawURL)
+	}
+
+	req := &Request{
+		Method:  method,
+		URL:     u,
+		Headers: headers.NewHeaders(),
+		Body:    body,
+	}
+	switch b := body.(type) {
+	case nil:
+	case *bytes.Buffer:
+		req.ContentLength = int64(b.Len())
+	case *bytes.Reader:
+		req.ContentLength = int64(b.Len())
+	case *strings.Reader:
+		req.ContentLength = int64(b.Len())
+	default:
+		req.ContentLength = -1
+	}
+	return req, nil
+}
+
+// Get sends a GET request for rawURL.
+func (c *Client) Get(rawURL string) (*response.Response, error) {
+	req, err := NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.Do(req)
+}
+
+// Do sends req and returns the response once its headers are read. The body
+// is streamed from the connection through the response's BodyReader, which
+// must be read to the end or closed for the connection to be used again.
+//
+// A GET, HEAD, OPTIONS or TRACE request without a body is sent again on a new
+// connection if a pooled one turns out to have been closed by the server.
+// Other requests fail instead, since the server may have acted on them before
+// closing the connection.
+func (c *Client) Do(req *Request) (*response.Response, error) {
+	key, addr := hostKey(req.URL)
+	for {
+		cn, reused, err := c.getConn(key, addr, req.URL)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := c.roundTrip(cn, req)
+		if err == nil {
+			return resp, nil
+		}
+		cn.Close()
+		if !(reused && req.Body == nil && idempotent(req.Method) && isStale(err)) {
+			return nil, err
+		}
+	}
+}
+
+// roundTrip writes req on cn and reads the response headers.
+func (c *Client) roundTrip(cn *conn, req *Request) (*response.Response, error) {
+	start := time.Now()
+	cn.SetDeadline(stream.Deadline(start, c.config.Timeout))
+	if err := writeRequest(cn.out, req); err != nil {
+		return nil, err
+	}
+
+	if c.config.ResponseHeaderTimeout > 0 {
+		headerDeadline := time.Now().Add(c.config.ResponseHeaderTimeout)
+		if c.config.Timeout <= 0 || headerDeadline.Before(start.Add(c.config.Timeout)) {
+			cn.SetReadDeadline(headerDeadline)
+		}
+	}
+	method := req.Method
+	if method == "" {
+		method = "GET"
+	}
+	var resp *response.Response
+	for {
+		var err error
+		resp, err = cn.reader.ReadResponse(method)
+		if err != nil {
+			return nil, err
+		}
+		// interim responses come before the final one
+		statusCode := resp.StatusLine.StatusCode
+		if statusCode >= 200 || statusCode == response.StatusSwitchingProtocols {
+			break
+		}
+	}
+	cn.SetReadDeadline(stream.Deadline(start, c.config.Timeout))
+
+	keepAlive := resp.KeepAlive() && (req.Headers == nil || !req.Headers.HasToken("Connection", "close"))
+	resp.BodyReader = &body{
+		client:    c,
+		conn:      cn,
+		reader:    resp.BodyReader,
+		keepAlive: keepAlive,
+	}
+	return resp, nil
+}
+
+// writeRequest serializes req to out, adding the Host header and the body
+// framing unless req sets them.
+func writeRequest(out *bufio.Writer, req *Request) error {
+	h := headers.NewHeaders()
+	if req.Headers != nil {
+		h = req.Headers.Clone()
+	}
+	if !h.Has("Host") {
+		h.Set("Host", req.URL.Host)
+	}
+	if req.Body != nil && !h.Has("Content-Length") && !h.Has("Transfer-Encoding") {
+		if req.ContentLength >= 0 {
+			h.SetContentLength(req.ContentLength)
+		} else {
+			h.Set("Transfer-Encoding", "chunked")
+		}
+	}
+	method := req.Method
+	if method == "" {
+		method = "GET"
+	}
+
+	w := request.NewWriter(out)
+	if err := w.WriteRequestLine(method, req.URL.RequestURI()); err != nil {
+		return err
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return err
+	}
+	if req.Body != nil {
+		if _, err := io.Copy(w, req.Body); err != nil {
+			return err
+		}
+	}
+	return w.Finish()
+}
+
+// getConn returns an idle connection to key, or dials addr. reused tells
+// which one it is.
+func (c *Client) getConn(key, addr string, u *url.URL) (cn *conn, reused bool, err error) {
+	c.mu.Lock()
+	for len(c.idle[key]) > 0 {
+		conns := c.idle[key]
+		cn = conns[len(conns)-1]
+		c.idle[key] = conns[:len(conns)-1]
+		if time.Since(cn.idleSince) <= c.config.IdleTimeout {
+			c.mu.Unlock()
+			return cn, true, nil
+		}
+		cn.Close()
+	}
+	c.mu.Unlock()
+
+	netConn, err := c.dial(addr, u)
+	if err != nil {
+		return nil, false, err
+	}
+	return &conn{
+		Conn:   netConn,
+		key:    key,
+		reader: response.NewReaderWithOptions(netConn, response.ParseOptions{StreamBody: true}),
+		out:    bufio.NewWriterSize(netConn, writeBufferSize),
+	}, false, nil
+}
+
+// dial opens a connection to addr, over TLS for https URLs.
+func (c *Client) dial(addr string, u *url.URL) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.config.DialTimeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	netConn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" {
+		return netConn, nil
+	}
+
+	config := &tls.Config{}
+	if c.config.TLSConfig != nil {
+		config = c.config.TLSConfig.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName = u.Hostname()
+	}
+	tlsConn := tls.Client(netConn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// putConn returns cn to the pool, or closes it if the pool for its host is
+// full.
+func (c *Client) putConn(cn *conn) {
+	cn.SetDeadline(time.Time{})
+	cn.idleSince = time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.idle[cn.key]) >= c.config.MaxIdleConnsPerHost {
+		cn.Close()
+		return
+	}
+	c.idle[cn.key] = append(c.idle[cn.key], cn)
+}
+
+// CloseIdleConnections closes the connections waiting in the pool.
+func (c *Client) CloseIdleConnections() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, conns := range c.idle {
+		for _, cn := range conns {
+			cn.Close()
+		}
+		delete(c.idle, key)
+	}
+}
+
+// body reads a response body from its connection, which goes back to the
+// pool once the body is read to the end or closed.
+type body struct {
+	client    *Client
+	conn      *conn
+	reader    io.ReadCloser
+	keepAlive bool
+}
+
+func (b *body) Read(p []byte) (int, error) {
+	n, err := b.reader.Read(p)
+	if err != nil && b.conn != nil {
+		b.release(errors.Is(err, io.EOF))
+	}
+	return n, err
+}
+
+// Close stops reading the body. What is left of it is skipped if short
+// enough, so the connection can serve another request.
+func (b *body) Close() error {
+	b.reader.Close()
+	if b.conn == nil {
+		return nil
+	}
+	err := b.conn.reader.DiscardBody(maxDiscardBytes)
+	b.release(err == nil)
+	return nil
+}
+
+// release hands the connection back to the pool if it can carry another
+// request, and closes it otherwise.
+func (b *body) release(reusable bool) {
+	cn := b.conn
+	b.conn = nil
+	if reusable && b.keepAlive {
+		b.client.putConn(cn)
+		return
+	}
+	cn.Close()
+}
+
+// hostKey returns the pool key and the address to dial for u.
+func hostKey(u *url.URL) (key, addr string) {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	addr = net.JoinHostPort(u.Hostname(), port)
+	return u.Scheme + "://" + addr, addr
+}
+
+// idempotent reports whether a request with method may be sent twice without
+// changing its effect on the server, an empty method standing for GET.
+func idempotent(method string) bool {
+	switch method {
+	case "", "GET", "HEAD", "OPTIONS", "TRACE":
+		return true
+	default:
+		return false
+	}
+}
+
+// isStale reports whether err is how a pooled connection the server closed
+// while idle fails, before anything of the response arrived.
+func isStale(err error) bool {
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE)
+}
@@ -0,0 +1,222 @@
+package client
+
+import (
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// echoHandler responds with the request method, target, body framing and
+// body.
+func echoHandler(w *response.Writer, req *request.Request) {
+	framing := "length"
+	if req.Headers.Has("Transfer-Encoding") {
+		framing = "chunked"
+	}
+	io.WriteString(w, req.RequestLine.Method+" "+req.RequestLine.RequestTarget+" "+framing+":"+string(req.Body))
+}
+
+// startServer serves handler on a local port and returns the base URL along
+// with the number of connections the server accepted so far.
+func startServer(t *testing.T, handler server.Handler, config server.Config) (string, *atomic.Int32) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	var conns atomic.Int32
+	config.Listener = listener
+	config.Handler = handler
+	config.ConnState = func(conn net.Conn, state server.ConnState) {
+		if state == server.StateNew {
+			conns.Add(1)
+		}
+	}
+	s := server.New(config)
+	go s.ListenAndServe()
+	t.Cleanup(func() { s.Close() })
+	return "http://" + listener.Addr().String(), &conns
+}
+
+// readBody reads the whole body of resp.
+func readBody(t *testing.T, resp *response.Response) string {
+	t.Helper()
+	body, err := io.ReadAll(resp.BodyReader)
+	require.NoError(t, err)
+	require.NoError(t, resp.BodyReader.Close())
+	return string(body)
+}
+
+func TestDo(t *testing.T) {
+	base, _ := startServer(t, echoHandler, server.Config{})
+	c := New(Config{Timeout: 5 * time.Second})
+	t.Cleanup(c.CloseIdleConnections)
+
+	// Test: GET
+	resp, err := c.Get(base + "/path?q=1")
+	require.NoError(t, err)
+	assert.Equal(t, response.StatusOK, resp.StatusLine.StatusCode)
+	assert.Equal(t, "GET /path?q=1 length:", readBody(t, resp))
+
+	// Test: Body of known length
+	req, err := NewRequest("POST", base+"/upload", strings.NewReader("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), req.ContentLength)
+	resp, err = c.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, "POST /upload length:hello", readBody(t, resp))
+
+	// Test: Body of unknown length is sent chunked
+	req, err = NewRequest("POST", base+"/upload", io.MultiReader(strings.NewReader("hello "), strings.NewReader("world")))
+	require.NoError(t, err)
+	assert.Equal(t, int64(-1), req.ContentLength)
+	resp, err = c.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, "POST /upload chunked:hello world", readBody(t, resp))
+
+	// Test: HEAD responses have no body
+	req, err = NewRequest("HEAD", base+"/", nil)
+	require.NoError(t, err)
+	resp, err = c.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, "", readBody(t, resp))
+	assert.Equal(t, "14", resp.Headers.Get("Content-Length"))
+	resp, err = c.Get(base + "/after-head")
+	require.NoError(t, err)
+	assert.Equal(t, "GET /after-head length:", readBody(t, resp))
+
+	// Test: Invalid URLs
+	_, err = c.Get("ftp://example.com/")
+	assert.ErrorIs(t, err, ErrUnsupportedScheme)
+	_, err = c.Get("http:///path")
+	assert.Error(t, err)
+}
+
+func TestConnectionReuse(t *testing.T) {
+	// Test: Requests to the same host share a connection
+	base, conns := startServer(t, echoHandler, server.Config{})
+	c := New(Config{Timeout: 5 * time.Second})
+	t.Cleanup(c.CloseIdleConnections)
+	for i := 0; i < 3; i++ {
+		resp, err := c.Get(base + "/")
+		require.NoError(t, err)
+		readBody(t, resp)
+	}
+	assert.Equal(t, int32(1), conns.Load())
+
+	// Test: A body closed before its end is skipped to keep the connection
+	base, conns = startServer(t, func(w *response.Writer, req *request.Request) {
+		io.WriteString(w, strings.Repeat("a", 64<<10))
+	}, server.Config{})
+	resp, err := c.Get(base + "/")
+	require.NoError(t, err)
+	_, err = resp.BodyReader.Read(make([]byte, 10))
+	require.NoError(t, err)
+	require.NoError(t, resp.BodyReader.Close())
+	resp, err = c.Get(base + "/")
+	require.NoError(t, err)
+	assert.Len(t, readBody(t, resp), 64<<10)
+	assert.Equal(t, int32(1), conns.Load())
+
+	// Test: Connections the server closes after the response aren't reused
+	base, conns = startServer(t, func(w *response.Writer, req *request.Request) {
+		w.Header().Set("Connection", "close")
+		io.WriteString(w, "bye")
+	}, server.Config{})
+	for i := 0; i < 2; i++ {
+		resp, err := c.Get(base + "/")
+		require.NoError(t, err)
+		assert.Equal(t, "bye", readBody(t, resp))
+	}
+	assert.Equal(t, int32(2), conns.Load())
+
+	// Test: A pooled connection the server closed while idle is replaced
+	base, conns = startServer(t, echoHandler, server.Config{IdleTimeout: 20 * time.Millisecond})
+	resp, err = c.Get(base + "/one")
+	require.NoError(t, err)
+	assert.Equal(t, "GET /one length:", readBody(t, resp))
+	time.Sleep(100 * time.Millisecond)
+	resp, err = c.Get(base + "/two")
+	require.NoError(t, err)
+	assert.Equal(t, "GET /two length:", readBody(t, resp))
+	assert.Equal(t, int32(2), conns.Load())
+
+	// Test: A request that isn't idempotent isn't sent again
+	time.Sleep(100 * time.Millisecond)
+	req, err := NewRequest("POST", base+"/three", nil)
+	require.NoError(t, err)
+	_, err = c.Do(req)
+	assert.Error(t, err)
+	assert.Equal(t, int32(2), conns.Load())
+
+	// Test: Connections idle past IdleTimeout aren't reused
+	base, conns = startServer(t, echoHandler, server.Config{})
+	c = New(Config{Timeout: 5 * time.Second, IdleTimeout: 20 * time.Millisecond})
+	t.Cleanup(c.CloseIdleConnections)
+	resp, err = c.Get(base + "/")
+	require.NoError(t, err)
+	readBody(t, resp)
+	time.Sleep(50 * time.Millisecond)
+	resp, err = c.Get(base + "/")
+	require.NoError(t, err)
+	readBody(t, resp)
+	assert.Equal(t, int32(2), conns.Load())
+}
+
+func TestStreamingResponse(t *testing.T) {
+	// Test: Body is read as the server sends it
+	resume := make(chan struct{})
+	base, _ := startServer(t, func(w *response.Writer, req *request.Request) {
+		io.WriteString(w, "first")
+		w.Flush()
+		<-resume
+		io.WriteString(w, " second")
+	}, server.Config{})
+	c := New(Config{Timeout: 5 * time.Second})
+	t.Cleanup(c.CloseIdleConnections)
+
+	resp, err := c.Get(base + "/")
+	require.NoError(t, err)
+	assert.Equal(t, "chunked", resp.Headers.Get("Transfer-Encoding"))
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(resp.BodyReader, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "first", string(buf))
+	close(resume)
+	assert.Equal(t, " second", readBody(t, resp))
+}
+
+func TestTimeouts(t *testing.T) {
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+	base, _ := startServer(t, func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/body" {
+			io.WriteString(w, "partial")
+			w.Flush()
+		}
+		<-release
+	}, server.Config{})
+
+	// Test: No response headers within ResponseHeaderTimeout
+	c := New(Config{ResponseHeaderTimeout: 50 * time.Millisecond})
+	_, err := c.Get(base + "/headers")
+	var netErr net.Error
+	require.ErrorAs(t, err, &netErr)
+	assert.True(t, netErr.Timeout())
+
+	// Test: Timeout covers reading the body
+	c = New(Config{Timeout: 100 * time.Millisecond})
+	resp, err := c.Get(base + "/body")
+	require.NoError(t, err)
+	_, err = io.ReadAll(resp.BodyReader)
+	require.ErrorAs(t, err, &netErr)
+	assert.True(t, netErr.Timeout())
+}
@@ -2,12 +2,34 @@ package headers
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"iter"
+	"slices"
 	"strings"
 )
 
 const crlf = "\r\n"
 
+var (
+	ErrMalformedHeader    = errors.New("malformed header")
+	ErrInvalidHeaderName  = errors.New("invalid header name")
+	ErrInvalidHeaderValue = errors.New("invalid header value")
+)
+
+// ObsFold selects what Parse does with obsolete line folding, a field value
+// continued on a line starting with a space or tab.
+type ObsFold int
+
+const (
+	// ObsFoldReject makes Parse fail with ErrMalformedHeader.
+	ObsFoldReject ObsFold = iota
+	// ObsFoldReplace joins the continuation line to the value with a
+	// single space.
+	ObsFoldReplace
+)
+
 // isValidHeaderKey checks if the header key contains only valid characters according to HTTP spec
 func isValidHeaderKey(key string) bool {
 	for _, c := range key {
@@ -24,13 +46,64 @@ func isValidHeaderKey(key string) bool {
 	return true
 }
 
-type Headers map[string]string
+// isValidHeaderValue checks that the value only holds visible characters,
+// spaces and tabs, as allowed in a field value by RFC 9110. Anything else,
+// CR and LF in particular, could end the field early when written out.
+func isValidHeaderValue(value string) bool {
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c != '\t' && (c < ' ' || c == 0x7f) {
+			return false
+		}
+	}
+	return true
+}
 
-func NewHeaders() Headers {
-	return map[string]string{}
+// CanonicalKey returns the canonical form of a header field name: the first
+// letter and every letter following a hyphen in upper case, the others in
+// lower case, as in "Content-Type". Names with characters that aren't valid
+// in a field name are returned unchanged.
+func CanonicalKey(key string) string {
+	if !isValidHeaderKey(key) {
+		return key
+	}
+	b := []byte(key)
+	upper := true
+	for i, c := range b {
+		if upper && 'a' <= c && c <= 'z' {
+			c -= 'a' - 'A'
+		} else if !upper && 'A' <= c && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		b[i] = c
+		upper = c == '-'
+	}
+	return string(b)
+}
+
+type field struct {
+	name  string
+	value string
 }
 
-func (h Headers) Parse(data []byte) (n int, done bool, err error) {
+// Headers is an ordered list of header fields. A name may appear several
+// times, each value kept as its own field rather than joined with commas,
+// which would corrupt fields such as Set-Cookie. Every method takes names in
+// any case: they are stored, and written out, in their CanonicalKey form.
+type Headers struct {
+	fields []field
+
+	obsFold ObsFold
+	// lastParsed is one past the index of the last field added by Parse,
+	// the one a folded line continues, or 0 if there is none
+	lastParsed int
+}
+
+func NewHeaders() *Headers {
+	return &Headers{}
+}
+
+func (h *Headers) Parse(data []byte) (n int, done bool, err error) {
 	idx := bytes.Index(data, []byte(crlf))
 
 	if idx == -1 {
@@ -43,40 +116,208 @@ func (h Headers) Parse(data []byte) (n int, done bool, err error) {
 		return 2, true, nil
 	}
 
-	parts := bytes.SplitN(data[:idx], []byte(":"), 2)
+	line := data[:idx]
+	if line[0] == ' ' || line[0] == '\t' {
+		if h.lastParsed == 0 || h.lastParsed > len(h.fields) {
+			// a line starting with whitespace before the first field
+			// would be dropped by other parsers, reading it as a field
+			// lets a message be framed differently here than there
+			return 0, false, fmt.Errorf("%w: whitespace before the first field", ErrMalformedHeader)
+		}
+		if err := h.parseFold(line); err != nil {
+			return 0, false, err
+		}
+		return idx + 2, false, nil
+	}
+
+	parts := bytes.SplitN(line, []byte(":"), 2)
 	if len(parts) != 2 {
-		return 0, false, fmt.Errorf("malformed header: missing colon")
+		return 0, false, fmt.Errorf("%w: missing colon", ErrMalformedHeader)
 	}
 
 	key := string(parts[0])
 
-	if key != strings.TrimRight(key, " ") {
-		return 0, false, fmt.Errorf("invalid header name: %s", key)
+	// no whitespace is allowed between the name and the colon
+	if key != strings.TrimRight(key, " \t") {
+		return 0, false, fmt.Errorf("%w: %s", ErrInvalidHeaderName, key)
 	}
 
-	value := bytes.TrimSpace(parts[1])
-	key = strings.TrimSpace(key)
+	value := string(bytes.Trim(parts[1], " \t"))
+	if key == "" {
+		return 0, false, fmt.Errorf("%w: empty name", ErrInvalidHeaderName)
+	}
 	if !isValidHeaderKey(key) {
-		return 0, false, fmt.Errorf("invalid header name: contains invalid characters: %s", key)
+		return 0, false, fmt.Errorf("%w: contains invalid characters: %s", ErrInvalidHeaderName, key)
+	}
+	if !isValidHeaderValue(value) {
+		return 0, false, fmt.Errorf("%w: contains control characters: %s", ErrInvalidHeaderValue, key)
 	}
 
-	h.Set(strings.ToLower(key), string(value))
+	h.Add(key, value)
+	h.lastParsed = len(h.fields)
 	return idx + 2, false, nil
 }
 
-func (h Headers) Set(key, value string) {
-	if existingValue, exists := h[key]; exists {
-		h[key] = existingValue + ", " + value
-	} else {
-		h[key] = value
+// SetObsFold sets what Parse does with obsolete line folding. It is rejected
+// by default.
+func (h *Headers) SetObsFold(mode ObsFold) {
+	h.obsFold = mode
+}
+
+// parseFold handles line, which starts with whitespace and so continues the
+// value of the last parsed field.
+func (h *Headers) parseFold(line []byte) error {
+	if h.obsFold != ObsFoldReplace {
+		return fmt.Errorf("%w: obsolete line folding", ErrMalformedHeader)
+	}
+	value := string(bytes.Trim(line, " \t"))
+	if !isValidHeaderValue(value) {
+		return fmt.Errorf("%w: contains control characters", ErrInvalidHeaderValue)
+	}
+	f := &h.fields[h.lastParsed-1]
+	if f.value == "" {
+		f.value = value
+	} else if value != "" {
+		f.value += " " + value
+	}
+	return nil
+}
+
+// Validate checks that every field has a valid name and a value free of
+// control characters, so the fields can be written out without one of them
+// breaking into the next.
+func (h *Headers) Validate() error {
+	for _, f := range h.fields {
+		if f.name == "" || !isValidHeaderKey(f.name) {
+			return fmt.Errorf("%w: %q", ErrInvalidHeaderName, f.name)
+		}
+		if !isValidHeaderValue(f.value) {
+			return fmt.Errorf("%w: %s: %q", ErrInvalidHeaderValue, f.name, f.value)
+		}
+	}
+	return nil
+}
+
+// Add appends a field, keeping any existing values of key.
+func (h *Headers) Add(key, value string) {
+	h.fields = append(h.fields, field{name: CanonicalKey(key), value: value})
+}
+
+// Set replaces the values of key with value. The field keeps the position of
+// the first existing value, or is appended if there was none.
+func (h *Headers) Set(key, value string) {
+	for i := range h.fields {
+		if strings.EqualFold(h.fields[i].name, key) {
+			h.fields[i].value = value
+			h.delFrom(i+1, key)
+			return
+		}
 	}
+	h.Add(key, value)
+}
+
+// SetOverride sets a header value, replacing any existing value.
+//
+// Deprecated: Set replaces existing values too.
+func (h *Headers) SetOverride(key, value string) {
+	h.Set(key, value)
 }
 
-func (h Headers) Get(key string) string {
-	return h[strings.ToLower(key)]
+// Get returns the first value of key, or "" if there is none.
+func (h *Headers) Get(key string) string {
+	for _, f := range h.fields {
+		if strings.EqualFold(f.name, key) {
+			return f.value
+		}
+	}
+	return ""
 }
 
-// SetOverride sets a header value, replacing any existing value instead of appending
-func (h Headers) SetOverride(key, value string) {
-	h[strings.ToLower(key)] = value
+// Values returns every value of key, in the order they were added.
+func (h *Headers) Values(key string) []string {
+	var values []string
+	for _, f := range h.fields {
+		if strings.EqualFold(f.name, key) {
+			values = append(values, f.value)
+		}
+	}
+	return values
+}
+
+// Has reports whether key has at least one value.
+func (h *Headers) Has(key string) bool {
+	for _, f := range h.fields {
+		if strings.EqualFold(f.name, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Del removes every value of key.
+func (h *Headers) Del(key string) {
+	h.delFrom(0, key)
+}
+
+func (h *Headers) delFrom(start int, key string) {
+	kept := h.fields[:start]
+	for _, f := range h.fields[start:] {
+		if !strings.EqualFold(f.name, key) {
+			kept = append(kept, f)
+		}
+	}
+	clear(h.fields[len(kept):])
+	h.fields = kept
+}
+
+// Len returns the number of fields.
+func (h *Headers) Len() int {
+	return len(h.fields)
+}
+
+// Clone returns a copy of h that can be changed independently.
+func (h *Headers) Clone() *Headers {
+	return &Headers{fields: slices.Clone(h.fields)}
+}
+
+// All iterates over the fields in order, yielding the canonical name and the
+// value. A name appears once per value.
+func (h *Headers) All() iter.Seq2[string, string] {
+	return func(yield func(string, string) bool) {
+		for _, f := range h.fields {
+			if !yield(f.name, f.value) {
+				return
+			}
+		}
+	}
+}
+
+// Write writes the fields in order, followed by the empty line ending the
+// header section. Nothing is written if a field name or value is invalid,
+// which keeps values from injecting fields of their own.
+func (h *Headers) Write(w io.Writer) error {
+	if err := h.Validate(); err != nil {
+		return err
+	}
+	for _, f := range h.fields {
+		_, err := fmt.Fprintf(w, "%s: %s\r\n", f.name, f.value)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, crlf)
+	return err
+}
+
+// HasToken reports whether the comma-separated lists in the values of key
+// contain token, ignoring case.
+func (h *Headers) HasToken(key, token string) bool {
+	for _, value := range h.Values(key) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
 }
@@ -1,6 +1,7 @@
 package headers
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -14,28 +15,37 @@ func TestHeadersParse(t *testing.T) {
 	n, done, err := headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:42069", headers["host"])
+	assert.Equal(t, "localhost:42069", headers.Get("Host"))
 	assert.Equal(t, 23, n)
 	assert.False(t, done)
 
 	// Test: Valid single header with extra whitespace
 	headers = NewHeaders()
-	data = []byte("       Host: localhost:42069                           \r\n\r\n")
+	data = []byte("Host:        localhost:42069                           \r\n\r\n")
 	n, done, err = headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:42069", headers["host"])
+	assert.Equal(t, "localhost:42069", headers.Get("Host"))
 	assert.Equal(t, 57, n)
 	assert.False(t, done)
 
+	// Test: Whitespace before the first field
+	headers = NewHeaders()
+	data = []byte("       Host: localhost:42069\r\n\r\n")
+	n, done, err = headers.Parse(data)
+	require.ErrorIs(t, err, ErrMalformedHeader)
+	assert.Equal(t, 0, n)
+	assert.False(t, done)
+
 	// Test: Valid 2 headers with existing headers
-	headers = map[string]string{"host": "localhost:42069"}
+	headers = NewHeaders()
+	headers.Add("Host", "localhost:42069")
 	data = []byte("User-Agent: curl/7.81.0\r\nAccept: */*\r\n\r\n")
 	n, done, err = headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:42069", headers["host"])
-	assert.Equal(t, "curl/7.81.0", headers["user-agent"])
+	assert.Equal(t, "localhost:42069", headers.Get("Host"))
+	assert.Equal(t, "curl/7.81.0", headers.Get("User-Agent"))
 	assert.Equal(t, 25, n)
 	assert.False(t, done)
 
@@ -45,7 +55,7 @@ func TestHeadersParse(t *testing.T) {
 	n, done, err = headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Empty(t, headers)
+	assert.Equal(t, 0, headers.Len())
 	assert.Equal(t, 2, n)
 	assert.True(t, done)
 
@@ -57,6 +67,14 @@ func TestHeadersParse(t *testing.T) {
 	assert.Equal(t, 0, n)
 	assert.False(t, done)
 
+	// Test: Tab before the colon
+	headers = NewHeaders()
+	data = []byte("Content-Length\t: 3\r\n\r\n")
+	n, done, err = headers.Parse(data)
+	assert.ErrorIs(t, err, ErrInvalidHeaderName)
+	assert.Equal(t, 0, n)
+	assert.False(t, done)
+
 	// Test: invalid character in header name
 	headers = NewHeaders()
 	data = []byte("H©st: localhost:42069\r\n\r\n")
@@ -67,11 +85,194 @@ func TestHeadersParse(t *testing.T) {
 
 	// Test: Duplicate header values
 	headers = NewHeaders()
-	headers["set-person"] = "lane-loves-go"
+	headers.Add("Set-Person", "lane-loves-go")
 	data = []byte("Set-Person: prime-loves-zig\r\n\r\n")
 	n, done, err = headers.Parse(data)
 	require.NoError(t, err)
-	assert.Equal(t, "lane-loves-go, prime-loves-zig", headers["set-person"])
+	assert.Equal(t, []string{"lane-loves-go", "prime-loves-zig"}, headers.Values("set-person"))
+	assert.Equal(t, "lane-loves-go", headers.Get("Set-Person"))
 	assert.Equal(t, 29, n)
 	assert.False(t, done)
 }
+
+func TestHeadersWrite(t *testing.T) {
+	// Test: Fields written in order and parsed back
+	h := NewHeaders()
+	h.Add("content-type", "text/plain")
+	h.Add("Set-Cookie", "a=1")
+	h.Add("Set-Cookie", "b=2")
+	var sb strings.Builder
+	require.NoError(t, h.Write(&sb))
+	assert.Equal(t, "Content-Type: text/plain\r\nSet-Cookie: a=1\r\nSet-Cookie: b=2\r\n\r\n", sb.String())
+	parsed := NewHeaders()
+	data := []byte(sb.String())
+	for {
+		n, done, err := parsed.Parse(data)
+		require.NoError(t, err)
+		data = data[n:]
+		if done {
+			break
+		}
+	}
+	assert.Equal(t, 3, parsed.Len())
+	assert.Equal(t, "text/plain", parsed.Get("Content-Type"))
+	assert.Equal(t, []string{"a=1", "b=2"}, parsed.Values("Set-Cookie"))
+
+	// Test: Invalid values write nothing
+	h.Set("Location", "/next\r\nSet-Cookie: session=stolen")
+	sb.Reset()
+	assert.ErrorIs(t, h.Write(&sb), ErrInvalidHeaderValue)
+	assert.Empty(t, sb.String())
+}
+
+func TestHeadersFields(t *testing.T) {
+	// Test: Repeated fields stay separate and in order
+	h := NewHeaders()
+	h.Add("Content-Type", "text/html")
+	h.Add("Set-Cookie", "a=1; Path=/")
+	h.Add("Set-Cookie", "b=2, c=3")
+	h.Add("X-Custom", "yes")
+	assert.Equal(t, []string{"a=1; Path=/", "b=2, c=3"}, h.Values("set-cookie"))
+	assert.Equal(t, "a=1; Path=/", h.Get("SET-COOKIE"))
+	assert.True(t, h.Has("x-custom"))
+	assert.False(t, h.Has("X-Missing"))
+	assert.Nil(t, h.Values("X-Missing"))
+
+	var fields []string
+	for name, value := range h.All() {
+		fields = append(fields, name+": "+value)
+	}
+	assert.Equal(t, []string{
+		"Content-Type: text/html",
+		"Set-Cookie: a=1; Path=/",
+		"Set-Cookie: b=2, c=3",
+		"X-Custom: yes",
+	}, fields)
+
+	// Test: Clone is independent
+	clone := h.Clone()
+	clone.Add("X-Custom", "no")
+	assert.Equal(t, []string{"yes"}, h.Values("X-Custom"))
+	assert.Equal(t, []string{"yes", "no"}, clone.Values("X-Custom"))
+
+	// Test: Set replaces every value in place of the first one
+	h.Set("set-cookie", "d=4")
+	fields = nil
+	for name, value := range h.All() {
+		fields = append(fields, name+": "+value)
+	}
+	assert.Equal(t, []string{"Content-Type: text/html", "Set-Cookie: d=4", "X-Custom: yes"}, fields)
+
+	// Test: Set appends a new field
+	h.Set("Cache-Control", "no-store")
+	assert.Equal(t, 4, h.Len())
+	assert.Equal(t, "no-store", h.Get("cache-control"))
+
+	// Test: Del removes every value
+	h.Add("Set-Cookie", "e=5")
+	h.Del("SET-COOKIE")
+	assert.False(t, h.Has("Set-Cookie"))
+	assert.Equal(t, 3, h.Len())
+	assert.Equal(t, "text/html", h.Get("Content-Type"))
+	assert.Equal(t, "yes", h.Get("X-Custom"))
+
+	// Test: HasToken looks through every value
+	h.Add("Connection", "keep-alive")
+	h.Add("Connection", "Upgrade, Close")
+	assert.True(t, h.HasToken("connection", "close"))
+	assert.False(t, h.HasToken("connection", "te"))
+}
+
+func TestCanonicalKeys(t *testing.T) {
+	// Test: Canonical forms
+	assert.Equal(t, "Content-Type", CanonicalKey("content-type"))
+	assert.Equal(t, "Content-Type", CanonicalKey("CONTENT-TYPE"))
+	assert.Equal(t, "X-Request-Id", CanonicalKey("x-REQUEST-id"))
+	assert.Equal(t, "Etag", CanonicalKey("ETag"))
+	assert.Equal(t, "Host", CanonicalKey("Host"))
+	assert.Equal(t, "", CanonicalKey(""))
+	assert.Equal(t, "bad key", CanonicalKey("bad key"))
+
+	// Test: Parsed names are canonicalized
+	h := NewHeaders()
+	_, _, err := h.Parse([]byte("content-TYPE: text/plain\r\n"))
+	require.NoError(t, err)
+	_, _, err = h.Parse([]byte("X-FORWARDED-FOR: 10.0.0.1\r\n"))
+	require.NoError(t, err)
+	var names []string
+	for name := range h.All() {
+		names = append(names, name)
+	}
+	assert.Equal(t, []string{"Content-Type", "X-Forwarded-For"}, names)
+
+	// Test: Mixed-case Set, Add and Get address the same field
+	h = NewHeaders()
+	h.Set("content-length", "5")
+	h.Set("Content-Length", "6")
+	h.Add("CONTENT-type", "text/html")
+	h.Set("content-TYPE", "text/plain")
+	var fields []string
+	for name, value := range h.All() {
+		fields = append(fields, name+": "+value)
+	}
+	assert.Equal(t, []string{"Content-Length: 6", "Content-Type: text/plain"}, fields)
+	assert.Equal(t, "6", h.Get("CONTENT-LENGTH"))
+	assert.True(t, h.Has("content-type"))
+	h.Del("CoNtEnT-lEnGtH")
+	assert.Equal(t, 1, h.Len())
+}
+
+func TestHeaderValues(t *testing.T) {
+	// Test: Tabs, inner spaces and obs-text are allowed
+	h := NewHeaders()
+	_, _, err := h.Parse([]byte("X-Value: a\tb  c \xff\t\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "a\tb  c \xff", h.Get("X-Value"))
+
+	// Test: Control characters are rejected
+	for _, value := range []string{"a\x00b", "a\rb", "a\nb", "a\x7fb", "a\x1bb"} {
+		h = NewHeaders()
+		n, _, err := h.Parse([]byte("X-Value: " + value + "\r\n"))
+		assert.ErrorIs(t, err, ErrInvalidHeaderValue, "value %q", value)
+		assert.Equal(t, 0, n)
+	}
+
+	// Test: Empty names are rejected
+	h = NewHeaders()
+	_, _, err = h.Parse([]byte(": value\r\n"))
+	assert.ErrorIs(t, err, ErrInvalidHeaderName)
+
+	// Test: Obsolete line folding is rejected by default
+	h = NewHeaders()
+	data := []byte("X-Folded: a\r\n  b\r\n\r\n")
+	n, _, err := h.Parse(data)
+	require.NoError(t, err)
+	_, _, err = h.Parse(data[n:])
+	assert.ErrorIs(t, err, ErrMalformedHeader)
+
+	// Test: Obsolete line folding replaced with a space
+	h = NewHeaders()
+	h.SetObsFold(ObsFoldReplace)
+	data = []byte("X-Folded: a\r\n  b\r\n\tc\r\nX-Next: d\r\n\r\n")
+	for {
+		n, done, err := h.Parse(data)
+		require.NoError(t, err)
+		data = data[n:]
+		if done {
+			break
+		}
+	}
+	assert.Equal(t, "a b c", h.Get("X-Folded"))
+	assert.Equal(t, "d", h.Get("X-Next"))
+	assert.Equal(t, 2, h.Len())
+
+	// Test: Validate checks fields set by hand
+	h = NewHeaders()
+	h.Set("Location", "/ok")
+	require.NoError(t, h.Validate())
+	h.Add("X-Injected", "a\r\nSet-Cookie: b")
+	assert.ErrorIs(t, h.Validate(), ErrInvalidHeaderValue)
+	h = NewHeaders()
+	h.Add("Bad Name", "x")
+	assert.ErrorIs(t, h.Validate(), ErrInvalidHeaderName)
+}
@@ -0,0 +1,275 @@
+package headers
+
+import (
+	"fmt"
+	"mime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TimeFormat is the IMF-fixdate format used to write dates in fields such as
+// Date and Last-Modified. Times must be in UTC.
+const TimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// Obsolete date formats recipients still have to accept.
+const (
+	rfc850Format  = "Monday, 02-Jan-06 15:04:05 GMT"
+	asctimeFormat = "Mon Jan _2 15:04:05 2006"
+)
+
+// ParseContentLength parses a Content-Length value: a non-negative decimal
+// number, or a list of identical ones as sent by some intermediaries. Signs,
+// spaces within the number and trailing garbage are rejected.
+func ParseContentLength(value string) (int64, error) {
+	var length int64 = -1
+	for _, part := range strings.Split(value, ",") {
+		part = strings.Trim(part, " \t")
+		if part == "" {
+			return 0, fmt.Errorf("%w: empty Content-Length", ErrInvalidHeaderValue)
+		}
+		for i := 0; i < len(part); i++ {
+			if part[i] < '0' || part[i] > '9' {
+				return 0, fmt.Errorf("%w: Content-Length is not a number: %q", ErrInvalidHeaderValue, value)
+			}
+		}
+		n, err := strconv.ParseInt(part, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%w: Content-Length out of range: %q", ErrInvalidHeaderValue, value)
+		}
+		if length != -1 && n != length {
+			return 0, fmt.Errorf("%w: conflicting Content-Length values: %q", ErrInvalidHeaderValue, value)
+		}
+		length = n
+	}
+	return length, nil
+}
+
+// ContentLength returns the value of the Content-Length field, or -1 if
+// there is none. Repeated fields must all hold the same length.
+func (h *Headers) ContentLength() (int64, error) {
+	values := h.Values("Content-Length")
+	if len(values) == 0 {
+		return -1, nil
+	}
+	return ParseContentLength(strings.Join(values, ","))
+}
+
+// SetContentLength sets the Content-Length field to n.
+func (h *Headers) SetContentLength(n int64) {
+	h.Set("Content-Length", strconv.FormatInt(n, 10))
+}
+
+// ContentType returns the media type of the Content-Type field, lowercased,
+// and its parameters, keyed by lowercased name. It returns "" if there is no
+// such field.
+func (h *Headers) ContentType() (mediaType string, params map[string]string, err error) {
+	value := h.Get("Content-Type")
+	if value == "" {
+		return "", nil, nil
+	}
+	mediaType, params, err = mime.ParseMediaType(value)
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: Content-Type: %w", ErrInvalidHeaderValue, err)
+	}
+	return mediaType, params, nil
+}
+
+// SetContentType sets the Content-Type field to mediaType with params,
+// quoting parameter values where needed. It panics if mediaType or a
+// parameter name isn't a valid token.
+func (h *Headers) SetContentType(mediaType string, params map[string]string) {
+	value := mime.FormatMediaType(mediaType, params)
+	if value == "" {
+		panic(fmt.Sprintf("headers: invalid media type %q", mediaType))
+	}
+	h.Set("Content-Type", value)
+}
+
+// ParseTime parses an HTTP date in the IMF-fixdate format, or in the obsolete
+// RFC 850 and asctime formats.
+func ParseTime(value string) (time.Time, error) {
+	for _, layout := range []string{TimeFormat, rfc850Format, asctimeFormat} {
+		t, err := time.Parse(layout, value)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%w: invalid date: %q", ErrInvalidHeaderValue, value)
+}
+
+// Time returns the date held by the field key, such as Date or
+// If-Modified-Since. ok is false if there is no such field.
+func (h *Headers) Time(key string) (t time.Time, ok bool, err error) {
+	value := h.Get(key)
+	if value == "" {
+		return time.Time{}, false, nil
+	}
+	t, err = ParseTime(value)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return t, true, nil
+}
+
+// SetTime sets the field key to t in the IMF-fixdate format.
+func (h *Headers) SetTime(key string, t time.Time) {
+	h.Set(key, t.UTC().Format(TimeFormat))
+}
+
+// CacheControl returns the directives of the Cache-Control fields, keyed by
+// lowercased name. Directives without an argument, such as no-store, map to
+// "". Quoted arguments are unquoted.
+func (h *Headers) CacheControl() (map[string]string, error) {
+	directives := map[string]string{}
+	for _, value := range h.Values("Cache-Control") {
+		for _, item := range splitList(value) {
+			name, arg, hasArg := strings.Cut(item, "=")
+			name = strings.ToLower(strings.Trim(name, " \t"))
+			if name == "" || !isValidHeaderKey(name) {
+				return nil, fmt.Errorf("%w: Cache-Control directive: %q", ErrInvalidHeaderValue, item)
+			}
+			if hasArg {
+				var err error
+				arg, err = unquote(strings.Trim(arg, " \t"))
+				if err != nil {
+					return nil, fmt.Errorf("%w: Cache-Control directive: %q", ErrInvalidHeaderValue, item)
+				}
+			}
+			directives[name] = arg
+		}
+	}
+	return directives, nil
+}
+
+// SetCacheControl sets the Cache-Control field to directives, sorted by name.
+// Directives mapping to "" are written without an argument.
+func (h *Headers) SetCacheControl(directives map[string]string) {
+	names := make([]string, 0, len(directives))
+	for name := range directives {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	items := make([]string, 0, len(names))
+	for _, name := range names {
+		item := name
+		if arg := directives[name]; arg != "" {
+			item += "=" + quoteIfNeeded(arg)
+		}
+		items = append(items, item)
+	}
+	h.Set("Cache-Control", strings.Join(items, ", "))
+}
+
+// AcceptValue is an element of a quality-weighted list such as Accept or
+// Accept-Encoding.
+type AcceptValue struct {
+	// Value is the media range, coding or language, lowercased.
+	Value string
+	// Q is the weight of the value, from 0 to 1. 0 means not acceptable.
+	Q float64
+	// Params holds the other parameters of a media range.
+	Params map[string]string
+}
+
+// Accept parses the quality-weighted list in the fields key, such as Accept,
+// Accept-Encoding or Accept-Language. The values are sorted by decreasing
+// weight, keeping the order they were sent in for equal weights.
+func (h *Headers) Accept(key string) ([]AcceptValue, error) {
+	var accepted []AcceptValue
+	for _, value := range h.Values(key) {
+		for _, item := range splitList(value) {
+			parts := strings.Split(item, ";")
+			av := AcceptValue{
+				Value: strings.ToLower(strings.Trim(parts[0], " \t")),
+				Q:     1,
+			}
+			if av.Value == "" {
+				return nil, fmt.Errorf("%w: %s: %q", ErrInvalidHeaderValue, key, item)
+			}
+			for _, param := range parts[1:] {
+				name, arg, _ := strings.Cut(param, "=")
+				name = strings.ToLower(strings.Trim(name, " \t"))
+				arg, err := unquote(strings.Trim(arg, " \t"))
+				if err != nil {
+					return nil, fmt.Errorf("%w: %s: %q", ErrInvalidHeaderValue, key, item)
+				}
+				if name == "q" {
+					q, err := strconv.ParseFloat(arg, 64)
+					if err != nil || q < 0 || q > 1 {
+						return nil, fmt.Errorf("%w: %s: invalid weight: %q", ErrInvalidHeaderValue, key, item)
+					}
+					av.Q = q
+					continue
+				}
+				if av.Params == nil {
+					av.Params = map[string]string{}
+				}
+				av.Params[name] = arg
+			}
+			accepted = append(accepted, av)
+		}
+	}
+	sort.SliceStable(accepted, func(i, j int) bool {
+		return accepted[i].Q > accepted[j].Q
+	})
+	return accepted, nil
+}
+
+// splitList splits a comma-separated list, skipping empty elements and
+// commas within quoted strings.
+func splitList(value string) []string {
+	var items []string
+	start := 0
+	quoted := false
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; {
+		case c == '\\' && quoted:
+			i++
+		case c == '"':
+			quoted = !quoted
+		case c == ',' && !quoted:
+			items = appendItem(items, value[start:i])
+			start = i + 1
+		}
+	}
+	return appendItem(items, value[start:])
+}
+
+func appendItem(items []string, item string) []string {
+	item = strings.Trim(item, " \t")
+	if item == "" {
+		return items
+	}
+	return append(items, item)
+}
+
+// unquote returns the content of a quoted-string, or s itself if it isn't
+// quoted.
+func unquote(s string) (string, error) {
+	if !strings.HasPrefix(s, `"`) {
+		return s, nil
+	}
+	if len(s) < 2 || !strings.HasSuffix(s, `"`) {
+		return "", fmt.Errorf("unterminated quoted string: %s", s)
+	}
+	var b strings.Builder
+	for i := 1; i < len(s)-1; i++ {
+		if s[i] == '\\' && i+1 < len(s)-1 {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String(), nil
+}
+
+// quoteIfNeeded returns s as is if it is a token, or as a quoted-string.
+func quoteIfNeeded(s string) string {
+	if isValidHeaderKey(s) {
+		return s
+	}
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	return `"` + r.Replace(s) + `"`
+}
@@ -0,0 +1,159 @@
+package headers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContentLength(t *testing.T) {
+	// Test: Valid lengths
+	for value, want := range map[string]int64{
+		"0":                   0,
+		"42":                  42,
+		"007":                 7,
+		"5, 5":                5,
+		"9223372036854775807": 9223372036854775807,
+	} {
+		n, err := ParseContentLength(value)
+		require.NoError(t, err, "value %q", value)
+		assert.Equal(t, want, n, "value %q", value)
+	}
+
+	// Test: Invalid lengths
+	for _, value := range []string{"", "12abc", "-1", "+5", "1 2", "0x10", "5, 6", "5,", "9223372036854775808"} {
+		_, err := ParseContentLength(value)
+		assert.ErrorIs(t, err, ErrInvalidHeaderValue, "value %q", value)
+	}
+
+	// Test: Field accessors
+	h := NewHeaders()
+	n, err := h.ContentLength()
+	require.NoError(t, err)
+	assert.Equal(t, int64(-1), n)
+	h.SetContentLength(1024)
+	assert.Equal(t, "1024", h.Get("Content-Length"))
+	h.Add("Content-Length", "1024")
+	n, err = h.ContentLength()
+	require.NoError(t, err)
+	assert.Equal(t, int64(1024), n)
+	h.Add("Content-Length", "1")
+	_, err = h.ContentLength()
+	assert.ErrorIs(t, err, ErrInvalidHeaderValue)
+}
+
+func TestContentType(t *testing.T) {
+	// Test: Media type with parameters
+	h := NewHeaders()
+	h.Set("Content-Type", `Text/HTML; Charset="utf-8"; q=x`)
+	mediaType, params, err := h.ContentType()
+	require.NoError(t, err)
+	assert.Equal(t, "text/html", mediaType)
+	assert.Equal(t, map[string]string{"charset": "utf-8", "q": "x"}, params)
+
+	// Test: Formatting quotes parameters when needed
+	h.SetContentType("multipart/form-data", map[string]string{"boundary": "a b"})
+	assert.Equal(t, `multipart/form-data; boundary="a b"`, h.Get("Content-Type"))
+	h.SetContentType("text/plain", map[string]string{"charset": "utf-8"})
+	assert.Equal(t, "text/plain; charset=utf-8", h.Get("Content-Type"))
+
+	// Test: Missing and malformed
+	mediaType, _, err = NewHeaders().ContentType()
+	require.NoError(t, err)
+	assert.Equal(t, "", mediaType)
+	h.Set("Content-Type", "text/")
+	_, _, err = h.ContentType()
+	assert.ErrorIs(t, err, ErrInvalidHeaderValue)
+}
+
+func TestTime(t *testing.T) {
+	want := time.Date(1994, time.November, 6, 8, 49, 37, 0, time.UTC)
+
+	// Test: The three date formats
+	for _, value := range []string{
+		"Sun, 06 Nov 1994 08:49:37 GMT",
+		"Sunday, 06-Nov-94 08:49:37 GMT",
+		"Sun Nov  6 08:49:37 1994",
+	} {
+		got, err := ParseTime(value)
+		require.NoError(t, err, "value %q", value)
+		assert.True(t, want.Equal(got), "value %q: got %v", value, got)
+	}
+	_, err := ParseTime("yesterday")
+	assert.ErrorIs(t, err, ErrInvalidHeaderValue)
+
+	// Test: Field accessors write IMF-fixdate in UTC
+	h := NewHeaders()
+	_, ok, err := h.Time("Date")
+	require.NoError(t, err)
+	assert.False(t, ok)
+	h.SetTime("Last-Modified", want.In(time.FixedZone("CET", 3600)))
+	assert.Equal(t, "Sun, 06 Nov 1994 08:49:37 GMT", h.Get("Last-Modified"))
+	got, ok, err := h.Time("last-modified")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.True(t, want.Equal(got))
+}
+
+func TestCacheControl(t *testing.T) {
+	// Test: Directives across fields
+	h := NewHeaders()
+	h.Add("Cache-Control", `No-Cache="Set-Cookie, X-Id", max-age=60`)
+	h.Add("Cache-Control", "private,, no-store")
+	directives, err := h.CacheControl()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"no-cache": "Set-Cookie, X-Id",
+		"max-age":  "60",
+		"private":  "",
+		"no-store": "",
+	}, directives)
+
+	// Test: Formatting
+	h.SetCacheControl(map[string]string{"max-age": "3600", "public": "", "no-cache": "Set-Cookie"})
+	assert.Equal(t, `max-age=3600, no-cache=Set-Cookie, public`, h.Get("Cache-Control"))
+	h.SetCacheControl(map[string]string{"no-cache": "a, b"})
+	assert.Equal(t, `no-cache="a, b"`, h.Get("Cache-Control"))
+
+	// Test: Malformed directive
+	h.Set("Cache-Control", `max-age="60`)
+	_, err = h.CacheControl()
+	assert.ErrorIs(t, err, ErrInvalidHeaderValue)
+}
+
+func TestAccept(t *testing.T) {
+	// Test: Sorted by weight, keeping the order of equal weights
+	h := NewHeaders()
+	h.Add("Accept", "text/*;q=0.3, Text/HTML;q=0.7, text/html;level=1")
+	h.Add("Accept", "text/html;level=2;q=0.4, */*;q=0.5, application/json")
+	accepted, err := h.Accept("Accept")
+	require.NoError(t, err)
+	assert.Equal(t, []AcceptValue{
+		{Value: "text/html", Q: 1, Params: map[string]string{"level": "1"}},
+		{Value: "application/json", Q: 1},
+		{Value: "text/html", Q: 0.7},
+		{Value: "*/*", Q: 0.5},
+		{Value: "text/html", Q: 0.4, Params: map[string]string{"level": "2"}},
+		{Value: "text/*", Q: 0.3},
+	}, accepted)
+
+	// Test: Codings with a zero weight
+	h.Set("Accept-Encoding", "gzip, identity;q=0, br;q=0.9")
+	accepted, err = h.Accept("accept-encoding")
+	require.NoError(t, err)
+	assert.Equal(t, []AcceptValue{{Value: "gzip", Q: 1}, {Value: "br", Q: 0.9}, {Value: "identity", Q: 0}}, accepted)
+
+	// Test: Invalid weights
+	for _, value := range []string{"gzip;q=2", "gzip;q=abc", "gzip;q=-0.5"} {
+		h.Set("Accept-Encoding", value)
+		_, err = h.Accept("Accept-Encoding")
+		assert.ErrorIs(t, err, ErrInvalidHeaderValue, "value %q", value)
+	}
+
+	// Test: Missing field
+	accepted, err = NewHeaders().Accept("Accept-Language")
+	require.NoError(t, err)
+	assert.Empty(t, accepted)
+}
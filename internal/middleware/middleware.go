@@ -0,0 +1,116 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"time"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+)
+
+// RequestIDHeader is the request header carrying the request ID.
+const RequestIDHeader = "X-Request-Id"
+
+// Recover turns a panic in the handler into a 500 response and logs it with
+// its stack trace to logger, or the log package's standard logger if nil.
+// If the handler already started its response, a 500 can't be sent anymore,
+// so the panic is left to the server, which logs it and closes the
+// connection rather than letting the partial response pass for a whole one.
+func Recover(logger *log.Logger) server.Middleware {
+	if logger == nil {
+		logger = log.Default()
+	}
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			defer func() {
+				err := recover()
+				if err == nil {
+					return
+				}
+				if w.StatusCode() != 0 {
+					panic(err)
+				}
+				logger.Printf("panic serving %s %s: %v\n%s", req.RequestLine.Method, req.RequestLine.RequestTarget, err, debug.Stack())
+
+				body := "Internal Server Error\n"
+				w.WriteStatusLine(response.StatusInternalServerError)
+				h := headers.NewHeaders()
+				h.Set("Content-Type", "text/plain")
+				h.SetContentLength(int64(len(body)))
+				h.Set("Connection", "close")
+				w.WriteHeaders(h)
+				w.WriteBody([]byte(body))
+			}()
+			next(w, req)
+		}
+	}
+}
+
+// RequestID makes sure every request carries an X-Request-Id header,
+// generating a random one when the client didn't send it. The ID is sent
+// back in the response's X-Request-Id header.
+func RequestID() server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			id := req.Headers.Get(RequestIDHeader)
+			if id == "" {
+				id = newRequestID()
+				req.Headers.Set(RequestIDHeader, id)
+			}
+			w.Header().Set(RequestIDHeader, id)
+			next(w, req)
+		}
+	}
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// AccessLog logs one line per request to logger, or the log package's
+// standard logger if nil, once the handler returns.
+func AccessLog(logger *log.Logger) server.Middleware {
+	if logger == nil {
+		logger = log.Default()
+	}
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			start := time.Now()
+			next(w, req)
+
+			line := fmt.Sprintf("%s %s %d %d %v",
+				req.RequestLine.Method,
+				req.RequestLine.RequestTarget,
+				w.StatusCode(),
+				w.BytesWritten(),
+				time.Since(start),
+			)
+			if id := req.Headers.Get(RequestIDHeader); id != "" {
+				line += " id=" + id
+			}
+			logger.Println(line)
+		}
+	}
+}
+
+// Timing measures how long the handler takes and passes the duration to
+// record once it returns, even if it panics.
+func Timing(record func(req *request.Request, elapsed time.Duration)) server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			start := time.Now()
+			defer func() {
+				record(req, time.Since(start))
+			}()
+			next(w, req)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package middleware
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func serve(t *testing.T, handler server.Handler, rawRequest string) string {
+	t.Helper()
+	req, err := request.RequestFromReader(strings.NewReader(rawRequest))
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	handler(response.NewWriter(&buf), req)
+	return buf.String()
+}
+
+func ok(w *response.Writer, req *request.Request) {
+	w.WriteStatusLine(response.StatusOK)
+	h := headers.NewHeaders()
+	h.Set("Content-Length", "2")
+	w.WriteHeaders(h)
+	w.WriteBody([]byte("ok"))
+}
+
+func TestRecover(t *testing.T) {
+	var logs bytes.Buffer
+	logger := log.New(&logs, "", 0)
+
+	// Test: Panic before writing becomes a 500
+	handler := server.Chain(func(w *response.Writer, req *request.Request) {
+		panic("boom")
+	}, Recover(logger))
+	got := serve(t, handler, "GET /panic HTTP/1.1\r\n\r\n")
+	assert.True(t, strings.HasPrefix(got, "HTTP/1.1 500 Internal Server Error\r\n"), "got %q", got)
+	assert.Contains(t, got, "Connection: close\r\n")
+	assert.Contains(t, logs.String(), "panic serving GET /panic: boom")
+
+	// Test: Panic after the response started is left to the server
+	handler = server.Chain(func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusOK)
+		panic("late")
+	}, Recover(logger))
+	assert.PanicsWithValue(t, "late", func() {
+		serve(t, handler, "GET / HTTP/1.1\r\n\r\n")
+	})
+
+	// Test: The server closes the connection on a partial body
+	var serverLogs bytes.Buffer
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := server.New(server.Config{
+		Listener: listener,
+		Handler: server.Chain(func(w *response.Writer, req *request.Request) {
+			if req.RequestLine.RequestTarget == "/chunked" {
+				cw, _ := w.ChunkedBody()
+				io.WriteString(cw, "abc")
+				panic("late")
+			}
+			w.Header().SetContentLength(10)
+			io.WriteString(w, "hello")
+			panic("late")
+		}, Recover(logger)),
+		ErrorLog: log.New(&serverLogs, "", 0),
+	})
+	go s.ListenAndServe()
+	t.Cleanup(func() { s.Close() })
+
+	for target, body := range map[string]string{"/length": "hello", "/chunked": "3\r\nabc\r\n"} {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		require.NoError(t, err)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err = io.WriteString(conn, "GET "+target+" HTTP/1.1\r\n\r\nGET /next HTTP/1.1\r\n\r\n")
+		require.NoError(t, err)
+		raw, err := io.ReadAll(conn)
+		conn.Close()
+		require.NoError(t, err)
+		_, got, found := strings.Cut(string(raw), "\r\n\r\n")
+		require.True(t, found, "got %q", raw)
+		assert.Equal(t, body, got, "nothing completes the body of %s", target)
+	}
+	assert.Contains(t, serverLogs.String(), "panic serving GET /length: late")
+}
+
+func TestRequestID(t *testing.T) {
+	var seen string
+	handler := server.Chain(func(w *response.Writer, req *request.Request) {
+		seen = req.Headers.Get(RequestIDHeader)
+		ok(w, req)
+	}, RequestID())
+
+	// Test: Generated when missing
+	serve(t, handler, "GET / HTTP/1.1\r\n\r\n")
+	assert.Len(t, seen, 16)
+	first := seen
+	serve(t, handler, "GET / HTTP/1.1\r\n\r\n")
+	assert.NotEqual(t, first, seen)
+
+	// Test: Kept when sent by the client and sent back in the response
+	got := serve(t, handler, "GET / HTTP/1.1\r\nX-Request-Id: abc\r\n\r\n")
+	assert.Equal(t, "abc", seen)
+	assert.Contains(t, got, "\r\nX-Request-Id: abc\r\n")
+
+	// Test: Headers the handler sets win
+	handler = server.Chain(func(w *response.Writer, req *request.Request) {
+		w.Header().Set(RequestIDHeader, "mine")
+		w.WriteHeader(response.StatusNoContent)
+	}, RequestID())
+	got = serve(t, handler, "GET / HTTP/1.1\r\nX-Request-Id: abc\r\n\r\n")
+	assert.Contains(t, got, "\r\nX-Request-Id: mine\r\n")
+	assert.NotContains(t, got, "abc")
+}
+
+func TestAccessLogAndTiming(t *testing.T) {
+	var logs bytes.Buffer
+	var elapsed time.Duration
+	handler := server.Chain(ok,
+		RequestID(),
+		AccessLog(log.New(&logs, "", 0)),
+		Timing(func(req *request.Request, d time.Duration) { elapsed = d }),
+	)
+
+	serve(t, handler, "GET /path HTTP/1.1\r\nX-Request-Id: abc\r\n\r\n")
+	assert.True(t, strings.HasPrefix(logs.String(), "GET /path 200 2 "), "got %q", logs.String())
+	assert.True(t, strings.HasSuffix(logs.String(), " id=abc\n"), "got %q", logs.String())
+	assert.Greater(t, elapsed, time.Duration(0))
+}
+
+func TestChainOrder(t *testing.T) {
+	var order []string
+	mark := func(name string) server.Middleware {
+		return func(next server.Handler) server.Handler {
+			return func(w *response.Writer, req *request.Request) {
+				order = append(order, name+" in")
+				next(w, req)
+				order = append(order, name+" out")
+			}
+		}
+	}
+
+	handler := server.Chain(func(w *response.Writer, req *request.Request) {
+		order = append(order, "handler")
+	}, mark("a"), mark("b"))
+	serve(t, handler, "GET / HTTP/1.1\r\n\r\n")
+	assert.Equal(t, []string{"a in", "b in", "handler", "b out", "a out"}, order)
+}
@@ -0,0 +1,34 @@
+package request
+
+import (
+	"errors"
+
+	"httpfromtcp/internal/stream"
+)
+
+// Errors returned by the parser. They are wrapped with details about the
+// offending input, so match them with errors.Is.
+var (
+	ErrIncompleteRequest    = errors.New("incomplete request")
+	ErrMalformedRequestLine = errors.New("malformed request-line")
+	ErrInvalidMethod        = errors.New("invalid method")
+	ErrUnsupportedVersion   = errors.New("unsupported HTTP-version")
+	ErrInvalidContentLength = errors.New("invalid Content-Length header")
+
+	ErrInvalidTransferEncoding     = errors.New("invalid Transfer-Encoding header")
+	ErrUnsupportedTransferEncoding = errors.New("unsupported Transfer-Encoding")
+	ErrConflictingFraming          = errors.New("conflicting message framing")
+
+	ErrRequestLineTooLong = errors.New("request-line too long")
+	ErrHeadersTooLarge    = errors.New("header fields too large")
+	ErrBodyTooLarge       = errors.New("body too large")
+
+	ErrUnreadBody = stream.ErrUnreadBody
+	ErrBodyClosed = stream.ErrBodyClosed
+)
+
+// Errors returned by Writer, the same values as those of response.Writer.
+var (
+	ErrBodyOverrun  = stream.ErrBodyOverrun
+	ErrBodyUnderrun = stream.ErrBodyUnderrun
+)
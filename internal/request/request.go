@@ -7,15 +7,32 @@ import (
 	"io"
 	"strings"
 
+	"httpfromtcp/internal/chunked"
 	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/stream"
 )
 
 type Request struct {
 	RequestLine RequestLine
-	Headers     headers.Headers
+	Headers     *headers.Headers
 	Body        []byte
+	// BodyReader reads the body. When the request was parsed with
+	// StreamBody set it reads lazily from the connection and Body stays
+	// empty, otherwise it reads from Body.
+	BodyReader io.ReadCloser
+	// Trailers holds the trailer fields sent after a chunked body. With
+	// StreamBody set they are only available once BodyReader returned
+	// io.EOF.
+	Trailers *headers.Headers
 
-	state requestState
+	state         requestState
+	headerBytes   int
+	headerCount   int
+	options       ParseOptions
+	pathValues    map[string]string
+	contentLength int
+	bodyRead      int
+	chunkDecoder  *chunked.Decoder
 }
 
 type RequestLine struct {
@@ -30,55 +47,203 @@ const (
 	requestStateInitialized requestState = iota
 	requestStateParsingHeaders
 	requestStateParsingBody
+	requestStateParsingChunkedBody
 	requestStateDone
 )
 
 const crlf = "\r\n"
 const bufferSize = 8
 
+// streamBufferSize is the size the read buffer grows to before a body is
+// streamed, so that large bodies aren't read a few bytes at a time.
+const streamBufferSize = 32 << 10
+
+// Limits protecting the server from requests that would otherwise grow the
+// read buffer without bound.
+const (
+	defaultMaxRequestLineLength = 8 << 10
+	defaultMaxHeaderBytes       = 1 << 20
+	defaultMaxHeaderCount       = 100
+	defaultMaxBodyBytes         = 10 << 20
+)
+
+// ParseOptions sets the limits a Reader enforces. Zero values select the
+// defaults of an 8 KiB request line, 100 header fields taking up at most
+// 1 MiB and a 10 MiB body.
+type ParseOptions struct {
+	// MaxRequestLineLength bounds the length of the request line, not
+	// counting its CRLF.
+	MaxRequestLineLength int
+	// MaxHeaderBytes bounds the size of the header section, not counting
+	// the request line.
+	MaxHeaderBytes int
+	// MaxHeaderCount bounds the number of header fields.
+	MaxHeaderCount int
+	// MaxBodyBytes bounds the size of the body.
+	MaxBodyBytes int
+	// ObsFold selects whether header fields continued on the next line
+	// are rejected, the default, or unfolded.
+	ObsFold headers.ObsFold
+	// StreamBody makes ReadRequest return as soon as the header section is
+	// parsed, leaving the body to be read through Request.BodyReader.
+	StreamBody bool
+	// BufferSize is the size the read buffer starts at, growing as needed
+	// from there. Eight bytes when zero.
+	BufferSize int
+}
+
+func (o ParseOptions) withDefaults() ParseOptions {
+	if o.MaxRequestLineLength == 0 {
+		o.MaxRequestLineLength = defaultMaxRequestLineLength
+	}
+	if o.MaxHeaderBytes == 0 {
+		o.MaxHeaderBytes = defaultMaxHeaderBytes
+	}
+	if o.MaxHeaderCount == 0 {
+		o.MaxHeaderCount = defaultMaxHeaderCount
+	}
+	if o.MaxBodyBytes == 0 {
+		o.MaxBodyBytes = defaultMaxBodyBytes
+	}
+	if o.BufferSize == 0 {
+		o.BufferSize = bufferSize
+	}
+	return o
+}
+
+// Reader parses consecutive requests from a single connection. Bytes read
+// past the end of one request are kept and used as the start of the next one.
+type Reader struct {
+	buf       *stream.Buffer
+	onHeaders func()
+	options   ParseOptions
+	// body is the reader of the last streamed body
+	body *stream.Body
+}
+
+func NewReader(reader io.Reader) *Reader {
+	return NewReaderWithOptions(reader, ParseOptions{})
+}
+
+func NewReaderWithOptions(reader io.Reader, options ParseOptions) *Reader {
+	options = options.withDefaults()
+	return &Reader{
+		buf:     stream.NewBuffer(reader, options.BufferSize),
+		options: options,
+	}
+}
+
+// OnHeaders sets fn to be called each time ReadRequest has parsed the header
+// section of a request, before it starts reading the body.
+func (r *Reader) OnHeaders(fn func()) {
+	r.onHeaders = fn
+}
+
+// Wait blocks until at least one byte of the next request is available. It
+// returns io.EOF if the reader is exhausted first.
+func (r *Reader) Wait() error {
+	return r.buf.Wait()
+}
+
+// RequestFromReader parses a single request from reader. Any bytes read past
+// the end of the request are discarded.
 func RequestFromReader(reader io.Reader) (*Request, error) {
-	buf := make([]byte, bufferSize)
-	readToIndex := 0
+	return NewReader(reader).ReadRequest()
+}
+
+// ReadRequest parses the next request. It returns io.EOF if the underlying
+// reader is exhausted before any byte of a new request has been read.
+//
+// With StreamBody set, the body of the previous request must have been read
+// to the end, or skipped with DiscardBody, first, otherwise ErrUnreadBody is
+// returned.
+func (r *Reader) ReadRequest() (*Request, error) {
+	if r.body != nil {
+		if !r.body.Done() {
+			return nil, ErrUnreadBody
+		}
+		r.body = nil
+	}
+
 	req := &Request{
-		state:   requestStateInitialized,
-		Headers: headers.NewHeaders(),
-		Body:    []byte{},
+		state:    requestStateInitialized,
+		Headers:  headers.NewHeaders(),
+		Body:     []byte{},
+		Trailers: headers.NewHeaders(),
+		options:  r.options,
 	}
-	for req.state != requestStateDone {
-		if readToIndex >= len(buf) {
-			newBuf := make([]byte, len(buf)*2)
-			copy(newBuf, buf)
-			buf = newBuf
+	req.Headers.SetObsFold(r.options.ObsFold)
+	headersDone := false
+	for {
+		// parse whatever is already buffered first, a previous read may
+		// have pulled in the whole next request
+		numBytesParsed, err := req.parse(r.buf.Bytes())
+		if err != nil {
+			return nil, err
 		}
+		r.buf.Consume(numBytesParsed)
 
-		numBytesRead, err := reader.Read(buf[readToIndex:])
-		if err != nil {
-			if errors.Is(err, io.EOF) {
-				if req.state != requestStateDone {
-					return nil, fmt.Errorf("incomplete request")
-				}
-				break
+		if !headersDone && req.state > requestStateParsingHeaders {
+			headersDone = true
+			if r.onHeaders != nil {
+				r.onHeaders()
 			}
-			return nil, err
 		}
-		readToIndex += numBytesRead
 
-		numBytesParsed, err := req.parse(buf[:readToIndex])
-		if err != nil {
+		if req.state == requestStateDone {
+			req.BodyReader = io.NopCloser(bytes.NewReader(req.Body))
+			return req, nil
+		}
+		if headersDone && r.options.StreamBody {
+			r.buf.Grow(streamBufferSize)
+			r.body = stream.NewBody(r.buf, stream.Framing{
+				Parse: req.parseBody,
+				Done:  func() bool { return req.state == requestStateDone },
+				EOF:   func() error { return ErrIncompleteRequest },
+			})
+			req.BodyReader = r.body
+			return req, nil
+		}
+
+		if err := r.buf.Fill(); err != nil {
+			if errors.Is(err, io.EOF) {
+				if req.state == requestStateInitialized && r.buf.Len() == 0 {
+					return nil, io.EOF
+				}
+				return nil, ErrIncompleteRequest
+			}
 			return nil, err
 		}
+	}
+}
 
-		copy(buf, buf[numBytesParsed:])
-		readToIndex -= numBytesParsed
+// DiscardBody reads and throws away what is left of the last streamed body,
+// so that the next request can be read. It gives up with ErrUnreadBody if
+// more than max bytes are left.
+func (r *Reader) DiscardBody(max int) error {
+	if r.body == nil {
+		return nil
 	}
-	return req, nil
+	return r.body.Discard(max)
 }
 
-func parseRequestLine(data []byte) (*RequestLine, int, error) {
+// Buffered returns the number of bytes already read from the connection
+// that belong to requests not yet returned by ReadRequest.
+func (r *Reader) Buffered() int {
+	return r.buf.Len()
+}
+
+func parseRequestLine(data []byte, maxLength int) (*RequestLine, int, error) {
 	idx := bytes.Index(data, []byte(crlf))
 	if idx == -1 {
+		if len(data) > maxLength {
+			return nil, 0, fmt.Errorf("%w: more than %d bytes", ErrRequestLineTooLong, maxLength)
+		}
 		return nil, 0, nil
 	}
+	if idx > maxLength {
+		return nil, 0, fmt.Errorf("%w: %d bytes", ErrRequestLineTooLong, idx)
+	}
 	requestLineText := string(data[:idx])
 	requestLine, err := requestLineFromString(requestLineText)
 	if err != nil {
@@ -90,13 +255,13 @@ func parseRequestLine(data []byte) (*RequestLine, int, error) {
 func requestLineFromString(str string) (*RequestLine, error) {
 	parts := strings.Split(str, " ")
 	if len(parts) != 3 {
-		return nil, fmt.Errorf("poorly formatted request-line: %s", str)
+		return nil, fmt.Errorf("%w: %s", ErrMalformedRequestLine, str)
 	}
 
 	method := parts[0]
 	for _, c := range method {
 		if c < 'A' || c > 'Z' {
-			return nil, fmt.Errorf("invalid method: %s", method)
+			return nil, fmt.Errorf("%w: %s", ErrInvalidMethod, method)
 		}
 	}
 
@@ -104,16 +269,16 @@ func requestLineFromString(str string) (*RequestLine, error) {
 
 	versionParts := strings.Split(parts[2], "/")
 	if len(versionParts) != 2 {
-		return nil, fmt.Errorf("malformed start-line: %s", str)
+		return nil, fmt.Errorf("%w: %s", ErrMalformedRequestLine, str)
 	}
 
 	httpPart := versionParts[0]
 	if httpPart != "HTTP" {
-		return nil, fmt.Errorf("unrecognized HTTP-version: %s", httpPart)
+		return nil, fmt.Errorf("%w: unrecognized protocol: %s", ErrMalformedRequestLine, httpPart)
 	}
 	version := versionParts[1]
 	if version != "1.1" {
-		return nil, fmt.Errorf("unrecognized HTTP-version: %s", version)
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedVersion, version)
 	}
 
 	return &RequestLine{
@@ -126,6 +291,10 @@ func requestLineFromString(str string) (*RequestLine, error) {
 func (r *Request) parse(data []byte) (int, error) {
 	totalBytesParsed := 0
 	for r.state != requestStateDone {
+		if r.options.StreamBody && r.state > requestStateParsingHeaders {
+			// the body is left for BodyReader
+			break
+		}
 		n, err := r.parseSingle(data[totalBytesParsed:])
 		if err != nil {
 			return 0, err
@@ -142,7 +311,7 @@ func (r *Request) parse(data []byte) (int, error) {
 func (r *Request) parseSingle(data []byte) (int, error) {
 	switch r.state {
 	case requestStateInitialized:
-		requestLine, n, err := parseRequestLine(data)
+		requestLine, n, err := parseRequestLine(data, r.options.MaxRequestLineLength)
 		if err != nil {
 			// something actually went wrong
 			return 0, err
@@ -160,56 +329,153 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 			return 0, err
 		}
 		if n == 0 {
-			// need more data
+			// need more data, unless the header section is already too big
+			if r.headerBytes+len(data) > r.options.MaxHeaderBytes {
+				return 0, fmt.Errorf("%w: more than %d bytes", ErrHeadersTooLarge, r.options.MaxHeaderBytes)
+			}
 			return 0, nil
 		}
+		r.headerBytes += n
+		if r.headerBytes > r.options.MaxHeaderBytes {
+			return 0, fmt.Errorf("%w: more than %d bytes", ErrHeadersTooLarge, r.options.MaxHeaderBytes)
+		}
+		if !done {
+			r.headerCount++
+			if r.headerCount > r.options.MaxHeaderCount {
+				return 0, fmt.Errorf("%w: more than %d fields", ErrHeadersTooLarge, r.options.MaxHeaderCount)
+			}
+		}
 		if done {
-			r.state = requestStateParsingBody
+			if !r.Headers.Has("Transfer-Encoding") {
+				err = r.startBody()
+			} else {
+				err = r.startChunkedBody()
+			}
+			if err != nil {
+				return 0, err
+			}
 		}
 		return n, nil
+	case requestStateParsingBody, requestStateParsingChunkedBody:
+		n, chunk, err := r.parseBody(data)
+		if err != nil {
+			return 0, err
+		}
+		r.Body = append(r.Body, chunk...)
+		return n, nil
+	case requestStateDone:
+		return 0, fmt.Errorf("error: trying to read data in a done state")
+	default:
+		return 0, fmt.Errorf("unknown state")
+	}
+}
+
+// parseBody consumes the next piece of the body at the start of data. It
+// returns the number of bytes consumed and the body bytes among them, which
+// alias data. n is 0 when more data is needed.
+func (r *Request) parseBody(data []byte) (n int, chunk []byte, err error) {
+	switch r.state {
 	case requestStateParsingBody:
-		contentLength := r.Headers.Get("Content-Length")
-		if contentLength == "" {
-			// No Content-Length header, assume no body
+		// Anything past Content-Length belongs to the next request
+		remaining := r.contentLength - r.bodyRead
+		if len(data) > remaining {
+			data = data[:remaining]
+		}
+		r.bodyRead += len(data)
+		if r.bodyRead == r.contentLength {
 			r.state = requestStateDone
-			return 0, nil
 		}
-
-		// Parse Content-Length value
-		var expectedLength int
-		_, err := fmt.Sscanf(contentLength, "%d", &expectedLength)
+		return len(data), data, nil
+	case requestStateParsingChunkedBody:
+		n, chunk, err := r.chunkDecoder.Parse(data)
 		if err != nil {
-			return 0, fmt.Errorf("invalid Content-Length header: %s", contentLength)
+			return 0, nil, err
 		}
-
-		// Calculate how much more we need
-		remaining := expectedLength - len(r.Body)
-		if remaining <= 0 {
-			// Body is already complete
+		if r.bodyRead+len(chunk) > r.options.MaxBodyBytes {
+			return 0, nil, fmt.Errorf("%w: more than %d bytes", ErrBodyTooLarge, r.options.MaxBodyBytes)
+		}
+		r.bodyRead += len(chunk)
+		if r.chunkDecoder.Done() {
+			r.Trailers = r.chunkDecoder.Trailers()
 			r.state = requestStateDone
-			return 0, nil
 		}
+		return n, chunk, nil
+	default:
+		return 0, nil, nil
+	}
+}
 
-		// Check if we have more data than expected
-		if len(data) > remaining {
-			// We have more data than we need - this is an error
-			// Append what we need to see the full body length
-			r.Body = append(r.Body, data[:remaining]...)
-			return 0, fmt.Errorf("body length (%d) exceeds Content-Length (%d)", len(r.Body), expectedLength)
-		}
+// startBody checks the Content-Length of the request and sets up reading its
+// body.
+func (r *Request) startBody() error {
+	expectedLength, err := r.Headers.ContentLength()
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidContentLength, err)
+	}
+	if expectedLength == -1 {
+		// No Content-Length header, assume no body
+		r.state = requestStateDone
+		return nil
+	}
+	if expectedLength > int64(r.options.MaxBodyBytes) {
+		return fmt.Errorf("%w: %d bytes", ErrBodyTooLarge, expectedLength)
+	}
 
-		// Append all available data to body
-		r.Body = append(r.Body, data...)
+	r.contentLength = int(expectedLength)
+	if expectedLength == 0 {
+		r.state = requestStateDone
+	} else {
+		r.state = requestStateParsingBody
+	}
+	return nil
+}
 
-		// Check if body is complete
-		if len(r.Body) == expectedLength {
-			r.state = requestStateDone
-		}
+// startChunkedBody checks the Transfer-Encoding of the request and sets up
+// the decoding of its chunked body.
+func (r *Request) startChunkedBody() error {
+	transferEncoding := strings.Join(r.Headers.Values("Transfer-Encoding"), ",")
+	if r.Headers.Has("Content-Length") {
+		// a message with both is a request smuggling attempt or a
+		// broken client, either way its length can't be trusted
+		return fmt.Errorf("%w: Content-Length sent with Transfer-Encoding", ErrConflictingFraming)
+	}
 
-		return len(data), nil
-	case requestStateDone:
-		return 0, fmt.Errorf("error: trying to read data in a done state")
-	default:
-		return 0, fmt.Errorf("unknown state")
+	codings := strings.Split(transferEncoding, ",")
+	if !strings.EqualFold(strings.TrimSpace(codings[len(codings)-1]), "chunked") {
+		return fmt.Errorf("%w: chunked is not the final coding: %s", ErrInvalidTransferEncoding, transferEncoding)
+	}
+	if len(codings) > 1 {
+		return fmt.Errorf("%w: %s", ErrUnsupportedTransferEncoding, transferEncoding)
+	}
+
+	r.chunkDecoder = chunked.NewDecoder()
+	r.state = requestStateParsingChunkedBody
+	return nil
+}
+
+// KeepAlive reports whether the client allows the connection to be reused
+// after this request. HTTP/1.1 connections are persistent unless the client
+// sends "Connection: close".
+func (r *Request) KeepAlive() bool {
+	return !r.Headers.HasToken("Connection", "close")
+}
+
+// Path returns the path of the request target, without the query.
+func (r *Request) Path() string {
+	path, _, _ := strings.Cut(r.RequestLine.RequestTarget, "?")
+	return path
+}
+
+// PathValue returns the value of the named path parameter, as set by a
+// router matching the request, or "" if there is no such parameter.
+func (r *Request) PathValue(name string) string {
+	return r.pathValues[name]
+}
+
+// SetPathValue sets the named path parameter to value.
+func (r *Request) SetPathValue(name, value string) {
+	if r.pathValues == nil {
+		r.pathValues = map[string]string{}
 	}
+	r.pathValues[name] = value
 }
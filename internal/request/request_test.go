@@ -2,8 +2,12 @@ package request
 
 import (
 	"io"
+	"strings"
 	"testing"
 
+	"httpfromtcp/internal/chunked"
+	"httpfromtcp/internal/headers"
+
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -93,6 +97,17 @@ func (cr *chunkReader) Read(p []byte) (n int, err error) {
 	return n, nil
 }
 
+// countingReader counts the reads made through it.
+type countingReader struct {
+	io.Reader
+	reads int
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	cr.reads++
+	return cr.Reader.Read(p)
+}
+
 func TestHeaderParsing(t *testing.T) {
 	// Test: Standard Headers
 	reader := &chunkReader{
@@ -103,9 +118,9 @@ func TestHeaderParsing(t *testing.T) {
 	require.NoError(t, err)
 	require.NotNil(t, r)
 
-	assert.Equal(t, "localhost:42069", r.Headers["host"])
-	assert.Equal(t, "curl/7.81.0", r.Headers["user-agent"])
-	assert.Equal(t, "*/*", r.Headers["accept"])
+	assert.Equal(t, "localhost:42069", r.Headers.Get("Host"))
+	assert.Equal(t, "curl/7.81.0", r.Headers.Get("User-Agent"))
+	assert.Equal(t, "*/*", r.Headers.Get("Accept"))
 
 	// Test: Empty Headers
 	reader = &chunkReader{
@@ -133,7 +148,7 @@ func TestHeaderParsing(t *testing.T) {
 	r, err = RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "text/html, application/json", r.Headers["accept"])
+	assert.Equal(t, []string{"text/html", "application/json"}, r.Headers.Values("Accept"))
 
 	// Test: Case Insensitive Headers
 	reader = &chunkReader{
@@ -143,9 +158,9 @@ func TestHeaderParsing(t *testing.T) {
 	r, err = RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "localhost:42069", r.Headers["host"])
-	assert.Equal(t, "curl/7.81.0", r.Headers["user-agent"])
-	assert.Equal(t, "*/*", r.Headers["accept"])
+	assert.Equal(t, "localhost:42069", r.Headers.Get("Host"))
+	assert.Equal(t, "curl/7.81.0", r.Headers.Get("User-Agent"))
+	assert.Equal(t, "*/*", r.Headers.Get("Accept"))
 
 	// Test: Missing End of Headers
 	reader = &chunkReader{
@@ -163,8 +178,8 @@ func TestHeaderParsing(t *testing.T) {
 	r, err = RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "localhost:42069", r.Headers["host"])
-	assert.Equal(t, "curl/7.81.0", r.Headers["user-agent"])
+	assert.Equal(t, "localhost:42069", r.Headers.Get("Host"))
+	assert.Equal(t, "curl/7.81.0", r.Headers.Get("User-Agent"))
 
 	// Test: Header with invalid characters in key
 	reader = &chunkReader{
@@ -258,3 +273,440 @@ func TestBodyParsing(t *testing.T) {
 	assert.Equal(t, "123456789012345", string(r.Body))
 	assert.Equal(t, 15, len(r.Body))
 }
+
+func TestReaderMultipleRequests(t *testing.T) {
+	// Test: Pipelined requests delivered in a single read
+	reader := NewReader(&chunkReader{
+		data: "GET /one HTTP/1.1\r\nHost: localhost:42069\r\n\r\n" +
+			"POST /two HTTP/1.1\r\nContent-Length: 5\r\n\r\nhello" +
+			"GET /three HTTP/1.1\r\n\r\n",
+		numBytesPerRead: 1024,
+	})
+	r, err := reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/one", r.RequestLine.RequestTarget)
+	assert.Greater(t, reader.Buffered(), 0)
+
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/two", r.RequestLine.RequestTarget)
+	assert.Equal(t, "hello", string(r.Body))
+
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/three", r.RequestLine.RequestTarget)
+	assert.Equal(t, 0, reader.Buffered())
+
+	_, err = reader.ReadRequest()
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: Pipelined requests read in small chunks
+	reader = NewReader(&chunkReader{
+		data: "POST /one HTTP/1.1\r\nContent-Length: 3\r\n\r\nabc" +
+			"POST /two HTTP/1.1\r\nContent-Length: 3\r\n\r\ndef",
+		numBytesPerRead: 7,
+	})
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "abc", string(r.Body))
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/two", r.RequestLine.RequestTarget)
+	assert.Equal(t, "def", string(r.Body))
+
+	// Test: Truncated second request
+	reader = NewReader(&chunkReader{
+		data:            "GET /one HTTP/1.1\r\n\r\nGET /two HTT",
+		numBytesPerRead: 64,
+	})
+	_, err = reader.ReadRequest()
+	require.NoError(t, err)
+	_, err = reader.ReadRequest()
+	require.Error(t, err)
+	assert.NotErrorIs(t, err, io.EOF)
+
+	// Test: A buffer starting at BufferSize takes a request in one read
+	raw := "GET /one HTTP/1.1\r\nHost: localhost:42069\r\nUser-Agent: curl/7.81.0\r\nAccept: */*\r\n\r\n"
+	cr := &countingReader{Reader: strings.NewReader(raw)}
+	reader = NewReaderWithOptions(cr, ParseOptions{BufferSize: 4 << 10})
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/one", r.RequestLine.RequestTarget)
+	assert.Equal(t, 1, cr.reads)
+}
+
+func TestParseErrors(t *testing.T) {
+	// Test: Invalid number of parts in request line
+	reader := &chunkReader{
+		data:            "/coffee HTTP/1.1\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err := RequestFromReader(reader)
+	assert.ErrorIs(t, err, ErrMalformedRequestLine)
+
+	// Test: Lowercase method
+	reader = &chunkReader{
+		data:            "get / HTTP/1.1\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	assert.ErrorIs(t, err, ErrInvalidMethod)
+
+	// Test: Unsupported HTTP version
+	reader = &chunkReader{
+		data:            "GET / HTTP/2.0\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	assert.ErrorIs(t, err, ErrUnsupportedVersion)
+
+	// Test: Negative Content-Length
+	reader = &chunkReader{
+		data:            "POST / HTTP/1.1\r\nContent-Length: -1\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	assert.ErrorIs(t, err, ErrInvalidContentLength)
+
+	// Test: Content-Length with trailing garbage
+	reader = &chunkReader{
+		data:            "POST / HTTP/1.1\r\nContent-Length: 12abc\r\n\r\nhello world!",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	assert.ErrorIs(t, err, ErrInvalidContentLength)
+
+	// Test: Content-Length with a sign
+	reader = &chunkReader{
+		data:            "POST / HTTP/1.1\r\nContent-Length: +5\r\n\r\nhello",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	assert.ErrorIs(t, err, ErrInvalidContentLength)
+
+	// Test: Conflicting Content-Length values
+	reader = &chunkReader{
+		data:            "POST / HTTP/1.1\r\nContent-Length: 5\r\nContent-Length: 6\r\n\r\nhello!",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	assert.ErrorIs(t, err, ErrInvalidContentLength)
+
+	// Test: Content-Length over the body limit
+	reader = &chunkReader{
+		data:            "POST / HTTP/1.1\r\nContent-Length: 99999999999\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	assert.ErrorIs(t, err, ErrBodyTooLarge)
+
+	// Test: Request line over the limit without a CRLF
+	reader = &chunkReader{
+		data:            "GET /" + strings.Repeat("a", defaultMaxRequestLineLength),
+		numBytesPerRead: 1024,
+	}
+	_, err = RequestFromReader(reader)
+	assert.ErrorIs(t, err, ErrRequestLineTooLong)
+
+	// Test: Header section over the limit
+	reader = &chunkReader{
+		data:            "GET / HTTP/1.1\r\nX-Filler: " + strings.Repeat("a", defaultMaxHeaderBytes) + "\r\n\r\n",
+		numBytesPerRead: 4096,
+	}
+	_, err = RequestFromReader(reader)
+	assert.ErrorIs(t, err, ErrHeadersTooLarge)
+
+	// Test: Whitespace before the first field, even with folding allowed
+	cr := NewReaderWithOptions(&chunkReader{
+		data:            "POST / HTTP/1.1\r\n Transfer-Encoding: chunked\r\n\r\n0\r\n\r\n",
+		numBytesPerRead: 3,
+	}, ParseOptions{ObsFold: headers.ObsFoldReplace})
+	_, err = cr.ReadRequest()
+	assert.ErrorIs(t, err, headers.ErrMalformedHeader)
+
+	// Test: Connection closed mid-request
+	reader = &chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: localhost",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	assert.ErrorIs(t, err, ErrIncompleteRequest)
+}
+
+func TestParseLimits(t *testing.T) {
+	// Test: Request line at the limit
+	target := "/" + strings.Repeat("a", 15)
+	cr := NewReaderWithOptions(&chunkReader{
+		data:            "GET " + target + " HTTP/1.1\r\n\r\n",
+		numBytesPerRead: 3,
+	}, ParseOptions{MaxRequestLineLength: 29})
+	r, err := cr.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, target, r.RequestLine.RequestTarget)
+
+	// Test: Request line over the limit
+	cr = NewReaderWithOptions(&chunkReader{
+		data:            "GET " + target + "a HTTP/1.1\r\n\r\n",
+		numBytesPerRead: 3,
+	}, ParseOptions{MaxRequestLineLength: 29})
+	_, err = cr.ReadRequest()
+	assert.ErrorIs(t, err, ErrRequestLineTooLong)
+
+	// Test: Header bytes over the limit
+	cr = NewReaderWithOptions(&chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: localhost:42069\r\nX-Filler: aaaaaaaaaa\r\n\r\n",
+		numBytesPerRead: 3,
+	}, ParseOptions{MaxHeaderBytes: 32})
+	_, err = cr.ReadRequest()
+	assert.ErrorIs(t, err, ErrHeadersTooLarge)
+
+	// Test: Header count at and over the limit
+	fields := strings.Repeat("X-Field: value\r\n", 4)
+	cr = NewReaderWithOptions(&chunkReader{
+		data:            "GET / HTTP/1.1\r\n" + fields + "\r\n",
+		numBytesPerRead: 5,
+	}, ParseOptions{MaxHeaderCount: 4})
+	_, err = cr.ReadRequest()
+	require.NoError(t, err)
+	cr = NewReaderWithOptions(&chunkReader{
+		data:            "GET / HTTP/1.1\r\n" + fields + "Host: localhost\r\n\r\n",
+		numBytesPerRead: 5,
+	}, ParseOptions{MaxHeaderCount: 4})
+	_, err = cr.ReadRequest()
+	assert.ErrorIs(t, err, ErrHeadersTooLarge)
+
+	// Test: Default header count
+	cr = NewReader(&chunkReader{
+		data:            "GET / HTTP/1.1\r\n" + strings.Repeat("X-Field: value\r\n", defaultMaxHeaderCount+1) + "\r\n",
+		numBytesPerRead: 64,
+	})
+	_, err = cr.ReadRequest()
+	assert.ErrorIs(t, err, ErrHeadersTooLarge)
+
+	// Test: Body at and over the limit
+	cr = NewReaderWithOptions(&chunkReader{
+		data:            "POST / HTTP/1.1\r\nContent-Length: 5\r\n\r\nhello",
+		numBytesPerRead: 3,
+	}, ParseOptions{MaxBodyBytes: 5})
+	r, err = cr.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(r.Body))
+	cr = NewReaderWithOptions(&chunkReader{
+		data:            "POST / HTTP/1.1\r\nContent-Length: 6\r\n\r\nhello!",
+		numBytesPerRead: 3,
+	}, ParseOptions{MaxBodyBytes: 5})
+	_, err = cr.ReadRequest()
+	assert.ErrorIs(t, err, ErrBodyTooLarge)
+}
+
+func TestChunkedBodyParsing(t *testing.T) {
+	// Test: Standard chunked body
+	reader := &chunkReader{
+		data: "POST /submit HTTP/1.1\r\nHost: localhost:42069\r\nTransfer-Encoding: chunked\r\n\r\n" +
+			"5\r\nhello\r\n7\r\n world!\r\n0\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "hello world!", string(r.Body))
+	assert.Equal(t, 0, r.Trailers.Len())
+
+	// Test: Chunk extensions and uppercase hex sizes
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n" +
+			"A;name=value\r\n0123456789\r\n1;quoted=\"a b\"\r\n!\r\n0;last\r\n\r\n",
+		numBytesPerRead: 1,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "0123456789!", string(r.Body))
+
+	// Test: Trailers
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\nTransfer-Encoding: chunked\r\nTrailer: X-Checksum\r\n\r\n" +
+			"3\r\nabc\r\n0\r\nX-Checksum: 900150983cd24fb0\r\nX-Count: 3\r\n\r\n",
+		numBytesPerRead: 4,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "abc", string(r.Body))
+	assert.Equal(t, "900150983cd24fb0", r.Trailers.Get("X-Checksum"))
+	assert.Equal(t, "3", r.Trailers.Get("X-Count"))
+
+	// Test: Pipelined request after a chunked body
+	cr := NewReader(&chunkReader{
+		data: "POST /one HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nhi\r\n0\r\n\r\n" +
+			"GET /two HTTP/1.1\r\n\r\n",
+		numBytesPerRead: 100,
+	})
+	r, err = cr.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "hi", string(r.Body))
+	r, err = cr.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/two", r.RequestLine.RequestTarget)
+
+	// Test: Both Content-Length and Transfer-Encoding
+	reader = &chunkReader{
+		data:            "POST /submit HTTP/1.1\r\nContent-Length: 5\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	assert.ErrorIs(t, err, ErrConflictingFraming)
+
+	// Test: chunked is not the final coding
+	reader = &chunkReader{
+		data:            "POST /submit HTTP/1.1\r\nTransfer-Encoding: chunked, gzip\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	assert.ErrorIs(t, err, ErrInvalidTransferEncoding)
+
+	// Test: Other codings before chunked
+	reader = &chunkReader{
+		data:            "POST /submit HTTP/1.1\r\nTransfer-Encoding: gzip, chunked\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	assert.ErrorIs(t, err, ErrUnsupportedTransferEncoding)
+
+	// Test: Invalid chunk size
+	reader = &chunkReader{
+		data:            "POST /submit HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\nhello\r\n0\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	assert.ErrorIs(t, err, chunked.ErrMalformedChunk)
+
+	// Test: Chunk data longer than its size
+	reader = &chunkReader{
+		data:            "POST /submit HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nhello\r\n0\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	assert.ErrorIs(t, err, chunked.ErrMalformedChunk)
+
+	// Test: Missing last chunk
+	reader = &chunkReader{
+		data:            "POST /submit HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	assert.ErrorIs(t, err, ErrIncompleteRequest)
+
+	// Test: Chunked body over the body limit
+	cr = NewReaderWithOptions(&chunkReader{
+		data:            "POST /submit HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n5\r\nworld\r\n0\r\n\r\n",
+		numBytesPerRead: 3,
+	}, ParseOptions{MaxBodyBytes: 8})
+	_, err = cr.ReadRequest()
+	assert.ErrorIs(t, err, ErrBodyTooLarge)
+}
+
+func TestStreamBody(t *testing.T) {
+	stream := ParseOptions{StreamBody: true}
+
+	// Test: Content-Length body read through BodyReader
+	cr := NewReaderWithOptions(&chunkReader{
+		data:            "POST /submit HTTP/1.1\r\nContent-Length: 13\r\n\r\nhello world!\n",
+		numBytesPerRead: 3,
+	}, stream)
+	r, err := cr.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/submit", r.RequestLine.RequestTarget)
+	assert.Empty(t, r.Body)
+	body, err := io.ReadAll(r.BodyReader)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world!\n", string(body))
+
+	// Test: Request returned before the body arrives
+	source := &chunkReader{
+		data:            "POST /submit HTTP/1.1\r\nContent-Length: 5\r\n\r\nhello",
+		numBytesPerRead: 1,
+	}
+	cr = NewReaderWithOptions(source, stream)
+	r, err = cr.ReadRequest()
+	require.NoError(t, err)
+	assert.Less(t, source.pos, len(source.data))
+	body, err = io.ReadAll(r.BodyReader)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+
+	// Test: Chunked body with trailers, read in small pieces
+	cr = NewReaderWithOptions(&chunkReader{
+		data: "POST /submit HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n" +
+			"5\r\nhello\r\n7\r\n world!\r\n0\r\nX-Count: 2\r\n\r\n",
+		numBytesPerRead: 4,
+	}, stream)
+	r, err = cr.ReadRequest()
+	require.NoError(t, err)
+	var got []byte
+	buf := make([]byte, 3)
+	for {
+		n, err := r.BodyReader.Read(buf)
+		got = append(got, buf[:n]...)
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+	}
+	assert.Equal(t, "hello world!", string(got))
+	assert.Equal(t, "2", r.Trailers.Get("X-Count"))
+
+	// Test: Next request needs the body to be read or discarded
+	cr = NewReaderWithOptions(&chunkReader{
+		data: "POST /one HTTP/1.1\r\nContent-Length: 5\r\n\r\nhello" +
+			"POST /two HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nhi\r\n0\r\n\r\n" +
+			"GET /three HTTP/1.1\r\n\r\n",
+		numBytesPerRead: 7,
+	}, stream)
+	r, err = cr.ReadRequest()
+	require.NoError(t, err)
+	_, err = cr.ReadRequest()
+	assert.ErrorIs(t, err, ErrUnreadBody)
+	require.NoError(t, r.BodyReader.Close())
+	_, err = r.BodyReader.Read(buf)
+	assert.ErrorIs(t, err, ErrBodyClosed)
+	require.NoError(t, cr.DiscardBody(1024))
+	r, err = cr.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/two", r.RequestLine.RequestTarget)
+	require.NoError(t, cr.DiscardBody(1024))
+	r, err = cr.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/three", r.RequestLine.RequestTarget)
+	body, err = io.ReadAll(r.BodyReader)
+	require.NoError(t, err)
+	assert.Empty(t, body)
+
+	// Test: Discarding gives up past its limit
+	cr = NewReaderWithOptions(&chunkReader{
+		data:            "POST /submit HTTP/1.1\r\nContent-Length: 100\r\n\r\n" + strings.Repeat("a", 100),
+		numBytesPerRead: 10,
+	}, stream)
+	_, err = cr.ReadRequest()
+	require.NoError(t, err)
+	assert.ErrorIs(t, cr.DiscardBody(10), ErrUnreadBody)
+
+	// Test: Truncated body
+	cr = NewReaderWithOptions(&chunkReader{
+		data:            "POST /submit HTTP/1.1\r\nContent-Length: 10\r\n\r\nhello",
+		numBytesPerRead: 3,
+	}, stream)
+	r, err = cr.ReadRequest()
+	require.NoError(t, err)
+	_, err = io.ReadAll(r.BodyReader)
+	assert.ErrorIs(t, err, ErrIncompleteRequest)
+
+	// Test: Chunked body over the limit
+	cr = NewReaderWithOptions(&chunkReader{
+		data: "POST /submit HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n" +
+			"5\r\nhello\r\n5\r\nworld\r\n0\r\n\r\n",
+		numBytesPerRead: 3,
+	}, ParseOptions{StreamBody: true, MaxBodyBytes: 8})
+	r, err = cr.ReadRequest()
+	require.NoError(t, err)
+	_, err = io.ReadAll(r.BodyReader)
+	assert.ErrorIs(t, err, ErrBodyTooLarge)
+}
@@ -0,0 +1,216 @@
+package request
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"httpfromtcp/internal/headers"
+)
+
+type writerState int
+
+const (
+	writerStateInitial writerState = iota
+	writerStateRequestLineWritten
+	writerStateHeadersWritten
+	writerStateBodyDone
+)
+
+// Writer writes a request in order: the request line, the header fields,
+// then the body, framed by the Content-Length or chunked encoding the header
+// fields declare. A request declaring neither has no body. It is the client
+// side counterpart of response.Writer.
+type Writer struct {
+	w     io.Writer
+	state writerState
+
+	// declaredLength is the length the headers promise for the body, or
+	// -1 for a chunked body
+	declaredLength int64
+	bytesWritten   int64
+	chunked        bool
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{
+		w:     w,
+		state: writerStateInitial,
+	}
+}
+
+// WriteRequestLine writes an HTTP/1.1 request line. The method must be in
+// upper case and the target can't hold spaces or control characters, the
+// same rules the parser applies.
+func (w *Writer) WriteRequestLine(method, target string) error {
+	if w.state != writerStateInitial {
+		return errors.New("WriteRequestLine must be called first")
+	}
+	if method == "" || strings.IndexFunc(method, func(c rune) bool { return c < 'A' || c > 'Z' }) != -1 {
+		return fmt.Errorf("%w: %q", ErrInvalidMethod, method)
+	}
+	if target == "" || strings.IndexFunc(target, func(c rune) bool { return c <= ' ' || c == 0x7f }) != -1 {
+		return fmt.Errorf("%w: request target %q", ErrMalformedRequestLine, target)
+	}
+
+	_, err := fmt.Fprintf(w.w, "%s %s HTTP/1.1\r\n", method, target)
+	if err != nil {
+		return err
+	}
+	w.state = writerStateRequestLineWritten
+	return nil
+}
+
+// WriteHeaders writes the header fields in order, followed by the empty line
+// ending the header section, and notes how the body is framed. Nothing is
+// written if a field is invalid or the framing fields contradict each other.
+func (w *Writer) WriteHeaders(h *headers.Headers) error {
+	if w.state != writerStateRequestLineWritten {
+		return errors.New("WriteHeaders must be called after WriteRequestLine")
+	}
+	if err := h.Validate(); err != nil {
+		return err
+	}
+
+	w.chunked = h.HasToken("Transfer-Encoding", "chunked")
+	if w.chunked {
+		if h.Has("Content-Length") {
+			return fmt.Errorf("%w: Content-Length sent with Transfer-Encoding", ErrConflictingFraming)
+		}
+		w.declaredLength = -1
+	} else {
+		contentLength, err := h.ContentLength()
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidContentLength, err)
+		}
+		w.declaredLength = max(contentLength, 0)
+	}
+
+	if err := h.Write(w.w); err != nil {
+		return err
+	}
+	w.state = writerStateHeadersWritten
+	return nil
+}
+
+// Write writes p as part of the body, as a chunk if the body is chunked.
+// Writes past the declared Content-Length fail with ErrBodyOverrun without
+// sending anything.
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.state != writerStateHeadersWritten {
+		return 0, errors.New("Write must be called after WriteHeaders and before the body is finished")
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if w.declaredLength >= 0 && w.bytesWritten+int64(len(p)) > w.declaredLength {
+		return 0, fmt.Errorf("%w: %d bytes after %d of %d", ErrBodyOverrun,
+			len(p), w.bytesWritten, w.declaredLength)
+	}
+
+	if !w.chunked {
+		n, err := w.w.Write(p)
+		w.bytesWritten += int64(n)
+		return n, err
+	}
+	if _, err := fmt.Fprintf(w.w, "%x\r\n", len(p)); err != nil {
+		return 0, err
+	}
+	n, err := w.w.Write(p)
+	w.bytesWritten += int64(n)
+	if err != nil {
+		return n, err
+	}
+	_, err = io.WriteString(w.w, crlf)
+	return n, err
+}
+
+// EndChunkedBody ends a chunked body with the last chunk, the trailer
+// fields, which may be nil, and the empty line completing the request.
+func (w *Writer) EndChunkedBody(trailers *headers.Headers) error {
+	if w.state != writerStateHeadersWritten || !w.chunked {
+		return errors.New("EndChunkedBody must be called after WriteHeaders declared a chunked body")
+	}
+	if trailers == nil {
+		trailers = headers.NewHeaders()
+	}
+	if err := trailers.Validate(); err != nil {
+		return err
+	}
+
+	if _, err := io.WriteString(w.w, "0\r\n"); err != nil {
+		return err
+	}
+	if err := trailers.Write(w.w); err != nil {
+		return err
+	}
+	w.state = writerStateBodyDone
+	return w.flush()
+}
+
+// Finish completes the request: a chunked body gets its last chunk, and a
+// body shorter than its declared Content-Length fails with ErrBodyUnderrun,
+// since the request can't be completed. The underlying writer is flushed if
+// it has a Flush method.
+func (w *Writer) Finish() error {
+	switch w.state {
+	case writerStateHeadersWritten:
+		if w.chunked {
+			return w.EndChunkedBody(nil)
+		}
+		if w.bytesWritten < w.declaredLength {
+			return fmt.Errorf("%w: wrote %d of %d bytes", ErrBodyUnderrun, w.bytesWritten, w.declaredLength)
+		}
+		w.state = writerStateBodyDone
+	case writerStateBodyDone:
+	default:
+		return errors.New("Finish must be called after WriteHeaders")
+	}
+	return w.flush()
+}
+
+// flush flushes the underlying writer if it buffers.
+func (w *Writer) flush() error {
+	if f, ok := w.w.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// Write serializes the request to w: the request line, the header fields in
+// order, then the body with the framing the fields declare, ending a chunked
+// body with the trailer fields. The body is taken from Body, or read from
+// BodyReader when Body is empty, as it is for streamed requests.
+//
+// Parsing a request and writing it back gives the same bytes for canonical
+// input: header names in canonical form followed by ": ", and a chunked body
+// sent as a single chunk. A streamed chunked body is written in pieces as
+// they arrive.
+func (r *Request) Write(w io.Writer) error {
+	rw := NewWriter(w)
+	if err := rw.WriteRequestLine(r.RequestLine.Method, r.RequestLine.RequestTarget); err != nil {
+		return err
+	}
+	h := r.Headers
+	if h == nil {
+		h = headers.NewHeaders()
+	}
+	if err := rw.WriteHeaders(h); err != nil {
+		return err
+	}
+
+	if len(r.Body) > 0 {
+		if _, err := rw.Write(r.Body); err != nil {
+			return err
+		}
+	} else if r.BodyReader != nil {
+		if _, err := io.Copy(rw, r.BodyReader); err != nil {
+			return err
+		}
+	}
+	if rw.chunked {
+		return rw.EndChunkedBody(r.Trailers)
+	}
+	return rw.Finish()
+}
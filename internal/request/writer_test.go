@@ -0,0 +1,171 @@
+package request
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/response"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriter(t *testing.T) {
+	// Test: Body of declared length
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	require.NoError(t, w.WriteRequestLine("POST", "/submit?x=1"))
+	h := headers.NewHeaders()
+	h.Set("Host", "localhost")
+	h.SetContentLength(11)
+	require.NoError(t, w.WriteHeaders(h))
+	_, err := io.WriteString(w, "hello")
+	require.NoError(t, err)
+	_, err = io.WriteString(w, " world")
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "POST /submit?x=1 HTTP/1.1\r\nHost: localhost\r\nContent-Length: 11\r\n\r\nhello world", buf.String())
+
+	// Test: Chunked body with trailers parses back
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteRequestLine("PUT", "/upload"))
+	h = headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err = io.WriteString(w, "abc")
+	require.NoError(t, err)
+	_, err = io.WriteString(w, "de")
+	require.NoError(t, err)
+	trailers := headers.NewHeaders()
+	trailers.Set("X-Count", "5")
+	require.NoError(t, w.EndChunkedBody(trailers))
+	assert.Equal(t, "PUT /upload HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n2\r\nde\r\n0\r\nX-Count: 5\r\n\r\n", buf.String())
+	r, err := RequestFromReader(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, "abcde", string(r.Body))
+	assert.Equal(t, "5", r.Trailers.Get("X-Count"))
+
+	// Test: Finish ends a chunked body
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteRequestLine("POST", "/"))
+	h = headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	require.NoError(t, w.WriteHeaders(h))
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\n0\r\n\r\n"))
+
+	// Test: Body length is enforced
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteRequestLine("POST", "/"))
+	h = headers.NewHeaders()
+	h.SetContentLength(3)
+	require.NoError(t, w.WriteHeaders(h))
+	_, err = w.Write([]byte("abcd"))
+	assert.ErrorIs(t, err, ErrBodyOverrun)
+	assert.ErrorIs(t, err, response.ErrBodyOverrun)
+	_, err = w.Write([]byte("ab"))
+	require.NoError(t, err)
+	assert.ErrorIs(t, w.Finish(), ErrBodyUnderrun)
+
+	// Test: No framing means no body
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteRequestLine("GET", "/"))
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	_, err = w.Write([]byte("x"))
+	assert.ErrorIs(t, err, ErrBodyOverrun)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "GET / HTTP/1.1\r\n\r\n", buf.String())
+
+	// Test: Invalid request lines and framing write nothing
+	buf.Reset()
+	w = NewWriter(&buf)
+	assert.ErrorIs(t, w.WriteRequestLine("get", "/"), ErrInvalidMethod)
+	assert.ErrorIs(t, w.WriteRequestLine("GET", "/a b"), ErrMalformedRequestLine)
+	assert.ErrorIs(t, w.WriteRequestLine("GET", ""), ErrMalformedRequestLine)
+	assert.Empty(t, buf.String())
+	require.NoError(t, w.WriteRequestLine("POST", "/"))
+	h = headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	h.SetContentLength(3)
+	assert.ErrorIs(t, w.WriteHeaders(h), ErrConflictingFraming)
+	h = headers.NewHeaders()
+	h.Set("X-Injected", "a\r\nHost: evil")
+	assert.ErrorIs(t, w.WriteHeaders(h), headers.ErrInvalidHeaderValue)
+	assert.Equal(t, "POST / HTTP/1.1\r\n", buf.String())
+}
+
+func TestRequestWrite(t *testing.T) {
+	// Test: Canonical requests round-trip byte for byte
+	canonical := []string{
+		"GET / HTTP/1.1\r\n\r\n",
+		"GET /search?q=go HTTP/1.1\r\nHost: localhost:42069\r\nUser-Agent: curl/7.81.0\r\nAccept: */*\r\nAccept: text/html\r\n\r\n",
+		"POST /submit HTTP/1.1\r\nHost: localhost\r\nContent-Length: 13\r\n\r\nhello world!\n",
+		"POST /empty HTTP/1.1\r\nContent-Length: 0\r\n\r\n",
+		"PUT /upload HTTP/1.1\r\nTransfer-Encoding: chunked\r\nTrailer: X-Count\r\n\r\nc\r\nhello world!\r\n0\r\nX-Count: 12\r\n\r\n",
+		"PUT /upload HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n",
+	}
+	for _, raw := range canonical {
+		r, err := RequestFromReader(strings.NewReader(raw))
+		require.NoError(t, err)
+		var buf bytes.Buffer
+		require.NoError(t, r.Write(&buf))
+		assert.Equal(t, raw, buf.String())
+	}
+
+	// Test: Streamed requests round-trip
+	all := strings.Join(canonical, "")
+	cr := NewReaderWithOptions(strings.NewReader(all), ParseOptions{StreamBody: true})
+	var buf bytes.Buffer
+	for range canonical {
+		r, err := cr.ReadRequest()
+		require.NoError(t, err)
+		require.NoError(t, r.Write(&buf))
+	}
+	assert.Equal(t, all, buf.String())
+
+	// Test: Chunks of a body streamed in small pieces parse back the same
+	cr = NewReaderWithOptions(&chunkReader{data: canonical[4], numBytesPerRead: 3}, ParseOptions{StreamBody: true})
+	r, err := cr.ReadRequest()
+	require.NoError(t, err)
+	buf.Reset()
+	require.NoError(t, r.Write(&buf))
+	r, err = RequestFromReader(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world!", string(r.Body))
+	assert.Equal(t, "12", r.Trailers.Get("X-Count"))
+
+	// Test: Other input is written in canonical form
+	r, err = RequestFromReader(strings.NewReader("POST /submit HTTP/1.1\r\ncontent-length:  5 \r\nx-tag:a\r\n\r\nhello"))
+	require.NoError(t, err)
+	buf.Reset()
+	require.NoError(t, r.Write(&buf))
+	assert.Equal(t, "POST /submit HTTP/1.1\r\nContent-Length: 5\r\nX-Tag: a\r\n\r\nhello", buf.String())
+
+	r, err = RequestFromReader(strings.NewReader("POST /upload HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n2\r\nde\r\n0\r\n\r\n"))
+	require.NoError(t, err)
+	buf.Reset()
+	require.NoError(t, r.Write(&buf))
+	assert.Equal(t, "POST /upload HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nabcde\r\n0\r\n\r\n", buf.String())
+
+	// Test: Built requests get the same checks as Writer
+	h := headers.NewHeaders()
+	h.SetContentLength(10)
+	r = &Request{
+		RequestLine: RequestLine{Method: "POST", RequestTarget: "/"},
+		Headers:     h,
+		Body:        []byte("short"),
+	}
+	assert.ErrorIs(t, r.Write(io.Discard), ErrBodyUnderrun)
+	r = &Request{
+		RequestLine: RequestLine{Method: "GET", RequestTarget: "/"},
+		BodyReader:  io.NopCloser(strings.NewReader("unframed")),
+	}
+	assert.ErrorIs(t, r.Write(io.Discard), ErrBodyOverrun)
+}
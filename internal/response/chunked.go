@@ -0,0 +1,97 @@
+package response
+
+import (
+	"errors"
+
+	"httpfromtcp/internal/headers"
+)
+
+// ChunkedWriter writes a chunked response body, framing each write as a
+// chunk. Close ends the body with the last chunk and the trailers. It is
+// returned by Writer.ChunkedBody.
+type ChunkedWriter struct {
+	w        *Writer
+	trailers []trailer
+	closed   bool
+}
+
+// trailer is a trailer field whose value is computed once the body is done.
+type trailer struct {
+	name  string
+	value func() string
+}
+
+// ChunkedBody returns a writer for a chunked body. Called before the response
+// starts, it makes WriteHeader send Transfer-Encoding: chunked in place of any
+// Content-Length, and the first write or Close calls WriteHeader(StatusOK) if
+// the handler hasn't called it itself. Header is left as is, so a response
+// the handler sends with WriteStatusLine and WriteHeaders instead, like an
+// error page, isn't chunked. After WriteHeaders, the fields passed must have
+// left the body length undeclared or declared it chunked. For a status code
+// that allows no body, such as 204 or 304, the chunked framing is left out
+// and Close only completes the response.
+func (w *Writer) ChunkedBody() (*ChunkedWriter, error) {
+	c := &ChunkedWriter{w: w}
+	switch w.state {
+	case writerStateInitial:
+		w.chunkedBody = c
+	case writerStateHeadersWritten:
+		if !w.chunked && w.pending == nil && bodyAllowed(w.statusCode) {
+			return nil, errors.New("ChunkedBody called on a body that isn't chunked")
+		}
+	default:
+		return nil, errors.New("ChunkedBody must be called before WriteStatusLine or after WriteHeaders")
+	}
+	return c, nil
+}
+
+// Trailer registers a trailer field sent by Close, with the value returned
+// by value at that point, like a checksum of the body. Fields registered
+// before the response starts are announced in the Trailer header sent by
+// WriteHeader, later ones must have been announced by the handler.
+func (c *ChunkedWriter) Trailer(name string, value func() string) {
+	name = headers.CanonicalKey(name)
+	switch {
+	case c.w.state == writerStateInitial:
+		// announced by WriteHeader along with the chunked encoding
+	case c.w.pending != nil:
+		// the headers held back can still announce it
+		c.w.pending.Add("Trailer", name)
+		if c.w.trailers == nil {
+			c.w.trailers = make(map[string]bool)
+		}
+		c.w.trailers[name] = true
+	}
+	c.trailers = append(c.trailers, trailer{name: name, value: value})
+}
+
+// Write writes p as a chunk of the body.
+func (c *ChunkedWriter) Write(p []byte) (int, error) {
+	if c.closed {
+		return 0, errors.New("write to a closed chunked body")
+	}
+	return c.w.Write(p)
+}
+
+// Flush sends the chunks written so far to the client, see Writer.Flush.
+func (c *ChunkedWriter) Flush() error {
+	return c.w.Flush()
+}
+
+// Close ends the body with the last chunk and the registered trailers,
+// checked like those passed to EndChunkedBody. Closing again does nothing.
+func (c *ChunkedWriter) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+
+	if err := c.w.implicitHeaders(); err != nil {
+		return err
+	}
+	trailers := headers.NewHeaders()
+	for _, t := range c.trailers {
+		trailers.Add(t.name, t.value())
+	}
+	return c.w.EndChunkedBody(trailers)
+}
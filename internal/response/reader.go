@@ -0,0 +1,427 @@
+package response
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"httpfromtcp/internal/chunked"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/stream"
+)
+
+// Errors returned by the response parser. They are wrapped with details
+// about the offending input, so match them with errors.Is.
+var (
+	ErrIncompleteResponse   = errors.New("incomplete response")
+	ErrMalformedStatusLine  = errors.New("malformed status-line")
+	ErrUnsupportedVersion   = errors.New("unsupported HTTP-version")
+	ErrInvalidContentLength = errors.New("invalid Content-Length header")
+	ErrConflictingFraming   = errors.New("conflicting message framing")
+
+	ErrStatusLineTooLong = errors.New("status-line too long")
+	ErrHeadersTooLarge   = errors.New("header fields too large")
+
+	ErrUnreadBody = stream.ErrUnreadBody
+	ErrBodyClosed = stream.ErrBodyClosed
+)
+
+// Response is a response parsed by ResponseFromReader or Reader.ReadResponse.
+type Response struct {
+	StatusLine StatusLine
+	Headers    *headers.Headers
+	Body       []byte
+	// BodyReader reads the body. When the response was read with
+	// StreamBody set it reads lazily from the connection and Body stays
+	// empty, otherwise it reads from Body.
+	BodyReader io.ReadCloser
+	// Trailers holds the trailer fields sent after a chunked body. With
+	// StreamBody set they are only available once BodyReader returned
+	// io.EOF.
+	Trailers *headers.Headers
+
+	state          responseState
+	noBody         bool
+	headerBytes    int
+	headerCount    int
+	contentLength  int64
+	bodyRead       int64
+	chunkDecoder   *chunked.Decoder
+	closeDelimited bool
+	streamBody     bool
+}
+
+type StatusLine struct {
+	HttpVersion  string
+	StatusCode   StatusCode
+	ReasonPhrase string
+}
+
+type responseState int
+
+const (
+	responseStateInitialized responseState = iota
+	responseStateParsingHeaders
+	responseStateParsingBody
+	responseStateParsingChunkedBody
+	responseStateParsingCloseDelimitedBody
+	responseStateDone
+)
+
+const crlf = "\r\n"
+const readBufferSize = 1 << 10
+
+// streamBufferSize is the size the read buffer grows to before a body is
+// streamed, so that large bodies aren't read a few bytes at a time.
+const streamBufferSize = 32 << 10
+
+// Limits protecting the client from responses that would otherwise grow the
+// read buffer without bound before their body.
+const (
+	maxStatusLineLength = 8 << 10
+	maxHeaderBytes      = 1 << 20
+	maxHeaderCount      = 100
+)
+
+// ParseOptions changes how a Reader reads responses.
+type ParseOptions struct {
+	// StreamBody makes ReadResponse return as soon as the header section
+	// is parsed, leaving the body to be read through Response.BodyReader.
+	StreamBody bool
+}
+
+// Reader parses consecutive responses from a single connection. Bytes read
+// past the end of one response are kept and used as the start of the next
+// one.
+type Reader struct {
+	buf     *stream.Buffer
+	options ParseOptions
+	// body is the reader of the last streamed body
+	body *stream.Body
+}
+
+func NewReader(reader io.Reader) *Reader {
+	return NewReaderWithOptions(reader, ParseOptions{})
+}
+
+func NewReaderWithOptions(reader io.Reader, options ParseOptions) *Reader {
+	return &Reader{
+		buf:     stream.NewBuffer(reader, readBufferSize),
+		options: options,
+	}
+}
+
+// ResponseFromReader parses a single response to a GET request from reader.
+// Any bytes read past the end of the response are discarded.
+func ResponseFromReader(reader io.Reader) (*Response, error) {
+	return NewReader(reader).ReadResponse("GET")
+}
+
+// ReadResponse parses the next response, sent for a request with method:
+// responses to HEAD have no body whatever their headers say. A body that is
+// neither chunked nor of declared length runs until the connection closes.
+// It returns io.EOF if the underlying reader is exhausted before any byte of
+// a new response has been read.
+//
+// With StreamBody set, the body of the previous response must have been read
+// to the end, or skipped with DiscardBody, first, otherwise ErrUnreadBody is
+// returned.
+func (r *Reader) ReadResponse(method string) (*Response, error) {
+	if r.body != nil {
+		if !r.body.Done() {
+			return nil, ErrUnreadBody
+		}
+		r.body = nil
+	}
+
+	resp := &Response{
+		state:      responseStateInitialized,
+		Headers:    headers.NewHeaders(),
+		Body:       []byte{},
+		Trailers:   headers.NewHeaders(),
+		noBody:     method == "HEAD",
+		streamBody: r.options.StreamBody,
+	}
+	for {
+		// parse whatever is already buffered first, a previous read may
+		// have pulled in the whole next response
+		numBytesParsed, err := resp.parse(r.buf.Bytes())
+		if err != nil {
+			return nil, err
+		}
+		r.buf.Consume(numBytesParsed)
+		if resp.state == responseStateDone {
+			resp.BodyReader = io.NopCloser(bytes.NewReader(resp.Body))
+			return resp, nil
+		}
+		if r.options.StreamBody && resp.state > responseStateParsingHeaders {
+			r.buf.Grow(streamBufferSize)
+			r.body = stream.NewBody(r.buf, stream.Framing{
+				Parse: resp.parseBody,
+				Done:  func() bool { return resp.state == responseStateDone },
+				EOF:   resp.endOfInput,
+			})
+			resp.BodyReader = r.body
+			return resp, nil
+		}
+
+		if err := r.buf.Fill(); err != nil {
+			if errors.Is(err, io.EOF) {
+				if resp.state == responseStateInitialized && r.buf.Len() == 0 {
+					return nil, io.EOF
+				}
+				if err := resp.endOfInput(); err != nil {
+					return nil, err
+				}
+				resp.BodyReader = io.NopCloser(bytes.NewReader(resp.Body))
+				return resp, nil
+			}
+			return nil, err
+		}
+	}
+}
+
+// DiscardBody reads and throws away what is left of the last streamed body,
+// so that the next response can be read. It gives up with ErrUnreadBody if
+// more than max bytes are left.
+func (r *Reader) DiscardBody(max int) error {
+	if r.body == nil {
+		return nil
+	}
+	return r.body.Discard(max)
+}
+
+func parseStatusLine(data []byte) (*StatusLine, int, error) {
+	idx := bytes.Index(data, []byte(crlf))
+	if idx == -1 {
+		if len(data) > maxStatusLineLength {
+			return nil, 0, fmt.Errorf("%w: more than %d bytes", ErrStatusLineTooLong, maxStatusLineLength)
+		}
+		return nil, 0, nil
+	}
+	if idx > maxStatusLineLength {
+		return nil, 0, fmt.Errorf("%w: %d bytes", ErrStatusLineTooLong, idx)
+	}
+	statusLine, err := statusLineFromString(string(data[:idx]))
+	if err != nil {
+		return nil, 0, err
+	}
+	return statusLine, idx + 2, nil
+}
+
+func statusLineFromString(str string) (*StatusLine, error) {
+	// the reason phrase may hold spaces, or be missing along with the
+	// space before it
+	version, rest, ok := strings.Cut(str, " ")
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrMalformedStatusLine, str)
+	}
+	code, reason, _ := strings.Cut(rest, " ")
+
+	protocol, versionNumber, ok := strings.Cut(version, "/")
+	if !ok || protocol != "HTTP" {
+		return nil, fmt.Errorf("%w: unrecognized protocol: %s", ErrMalformedStatusLine, version)
+	}
+	if versionNumber != "1.1" && versionNumber != "1.0" {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedVersion, versionNumber)
+	}
+
+	if len(code) != 3 {
+		return nil, fmt.Errorf("%w: status code %q", ErrMalformedStatusLine, code)
+	}
+	statusCode := 0
+	for _, c := range code {
+		if c < '0' || c > '9' {
+			return nil, fmt.Errorf("%w: status code %q", ErrMalformedStatusLine, code)
+		}
+		statusCode = statusCode*10 + int(c-'0')
+	}
+	if !StatusCode(statusCode).Valid() {
+		return nil, fmt.Errorf("%w: %d", ErrInvalidStatusCode, statusCode)
+	}
+
+	return &StatusLine{
+		HttpVersion:  versionNumber,
+		StatusCode:   StatusCode(statusCode),
+		ReasonPhrase: reason,
+	}, nil
+}
+
+func (r *Response) parse(data []byte) (int, error) {
+	totalBytesParsed := 0
+	for r.state != responseStateDone {
+		if r.streamBody && r.state > responseStateParsingHeaders {
+			// the body is left for BodyReader
+			break
+		}
+		n, err := r.parseSingle(data[totalBytesParsed:])
+		if err != nil {
+			return 0, err
+		}
+		if n == 0 {
+			// need more data
+			break
+		}
+		totalBytesParsed += n
+	}
+	return totalBytesParsed, nil
+}
+
+func (r *Response) parseSingle(data []byte) (int, error) {
+	switch r.state {
+	case responseStateInitialized:
+		statusLine, n, err := parseStatusLine(data)
+		if err != nil {
+			return 0, err
+		}
+		if n == 0 {
+			return 0, nil
+		}
+		r.StatusLine = *statusLine
+		r.state = responseStateParsingHeaders
+		return n, nil
+	case responseStateParsingHeaders:
+		n, done, err := r.Headers.Parse(data)
+		if err != nil {
+			return 0, err
+		}
+		if n == 0 {
+			// need more data, unless the header section is already too big
+			if r.headerBytes+len(data) > maxHeaderBytes {
+				return 0, fmt.Errorf("%w: more than %d bytes", ErrHeadersTooLarge, maxHeaderBytes)
+			}
+			return 0, nil
+		}
+		r.headerBytes += n
+		if r.headerBytes > maxHeaderBytes {
+			return 0, fmt.Errorf("%w: more than %d bytes", ErrHeadersTooLarge, maxHeaderBytes)
+		}
+		if !done {
+			r.headerCount++
+			if r.headerCount > maxHeaderCount {
+				return 0, fmt.Errorf("%w: more than %d fields", ErrHeadersTooLarge, maxHeaderCount)
+			}
+		}
+		if done {
+			if err := r.startBody(); err != nil {
+				return 0, err
+			}
+		}
+		return n, nil
+	case responseStateParsingBody, responseStateParsingChunkedBody, responseStateParsingCloseDelimitedBody:
+		n, chunk, err := r.parseBody(data)
+		if err != nil {
+			return 0, err
+		}
+		r.Body = append(r.Body, chunk...)
+		return n, nil
+	case responseStateDone:
+		return 0, fmt.Errorf("error: trying to read data in a done state")
+	default:
+		return 0, fmt.Errorf("unknown state")
+	}
+}
+
+// parseBody consumes the next piece of the body at the start of data. It
+// returns the number of bytes consumed and the body bytes among them, which
+// alias data. n is 0 when more data is needed. A body running until the
+// connection closes is only done once the reader hits io.EOF.
+func (r *Response) parseBody(data []byte) (n int, chunk []byte, err error) {
+	switch r.state {
+	case responseStateParsingBody:
+		// Anything past Content-Length belongs to the next response
+		remaining := r.contentLength - r.bodyRead
+		if int64(len(data)) > remaining {
+			data = data[:remaining]
+		}
+		r.bodyRead += int64(len(data))
+		if r.bodyRead == r.contentLength {
+			r.state = responseStateDone
+		}
+		return len(data), data, nil
+	case responseStateParsingChunkedBody:
+		n, chunk, err := r.chunkDecoder.Parse(data)
+		if err != nil {
+			return 0, nil, err
+		}
+		if r.chunkDecoder.Done() {
+			r.Trailers = r.chunkDecoder.Trailers()
+			r.state = responseStateDone
+		}
+		return n, chunk, nil
+	case responseStateParsingCloseDelimitedBody:
+		return len(data), data, nil
+	default:
+		return 0, nil, nil
+	}
+}
+
+// endOfInput is called when the connection ends before the response does.
+// It completes a body running until the connection closes, any other
+// response is incomplete.
+func (r *Response) endOfInput() error {
+	if r.state != responseStateParsingCloseDelimitedBody {
+		return ErrIncompleteResponse
+	}
+	r.state = responseStateDone
+	return nil
+}
+
+// startBody works out how the body of the response is framed, following
+// RFC 9112, section 6.3.
+func (r *Response) startBody() error {
+	statusCode := r.StatusLine.StatusCode
+	if r.noBody || !bodyAllowed(statusCode) {
+		r.state = responseStateDone
+		return nil
+	}
+
+	if r.Headers.Has("Transfer-Encoding") {
+		if r.Headers.Has("Content-Length") {
+			return fmt.Errorf("%w: Content-Length sent with Transfer-Encoding", ErrConflictingFraming)
+		}
+		codings := strings.Split(strings.Join(r.Headers.Values("Transfer-Encoding"), ","), ",")
+		if strings.EqualFold(strings.TrimSpace(codings[len(codings)-1]), "chunked") {
+			r.chunkDecoder = chunked.NewDecoder()
+			r.state = responseStateParsingChunkedBody
+			return nil
+		}
+		// other codings don't frame the body
+		r.closeDelimited = true
+		r.state = responseStateParsingCloseDelimitedBody
+		return nil
+	}
+
+	contentLength, err := r.Headers.ContentLength()
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidContentLength, err)
+	}
+	switch contentLength {
+	case -1:
+		r.closeDelimited = true
+		r.state = responseStateParsingCloseDelimitedBody
+	case 0:
+		r.state = responseStateDone
+	default:
+		r.contentLength = contentLength
+		r.state = responseStateParsingBody
+	}
+	return nil
+}
+
+// KeepAlive reports whether the server leaves the connection open for
+// another request after this response. HTTP/1.1 connections are persistent
+// unless the server sends "Connection: close", HTTP/1.0 ones only with
+// "Connection: keep-alive", and a body running until the connection closes
+// ends it either way.
+func (r *Response) KeepAlive() bool {
+	if r.closeDelimited {
+		return false
+	}
+	if r.StatusLine.HttpVersion == "1.0" {
+		return r.Headers.HasToken("Connection", "keep-alive")
+	}
+	return !r.Headers.HasToken("Connection", "close")
+}
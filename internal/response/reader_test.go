@@ -0,0 +1,283 @@
+package response
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"httpfromtcp/internal/headers"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// chunkReader hands out data a few bytes at a time, like a slow connection.
+type chunkReader struct {
+	data            string
+	numBytesPerRead int
+	pos             int
+}
+
+func (cr *chunkReader) Read(p []byte) (n int, err error) {
+	if cr.pos >= len(cr.data) {
+		return 0, io.EOF
+	}
+	endIndex := cr.pos + cr.numBytesPerRead
+	if endIndex > len(cr.data) {
+		endIndex = len(cr.data)
+	}
+	n = copy(p, cr.data[cr.pos:endIndex])
+	cr.pos += n
+	return n, nil
+}
+
+func TestStatusLineParse(t *testing.T) {
+	// Test: Good status line
+	reader := &chunkReader{
+		data:            "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err := ResponseFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "1.1", r.StatusLine.HttpVersion)
+	assert.Equal(t, StatusOK, r.StatusLine.StatusCode)
+	assert.Equal(t, "OK", r.StatusLine.ReasonPhrase)
+
+	// Test: Reason phrase with spaces
+	r, err = ResponseFromReader(strings.NewReader("HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, StatusNotFound, r.StatusLine.StatusCode)
+	assert.Equal(t, "Not Found", r.StatusLine.ReasonPhrase)
+
+	// Test: Empty or missing reason phrase
+	for _, line := range []string{"HTTP/1.1 299 ", "HTTP/1.1 299"} {
+		r, err = ResponseFromReader(strings.NewReader(line + "\r\nContent-Length: 0\r\n\r\n"))
+		require.NoError(t, err, line)
+		assert.Equal(t, StatusCode(299), r.StatusLine.StatusCode)
+		assert.Equal(t, "", r.StatusLine.ReasonPhrase)
+	}
+
+	// Test: HTTP/1.0
+	r, err = ResponseFromReader(strings.NewReader("HTTP/1.0 200 OK\r\nContent-Length: 0\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "1.0", r.StatusLine.HttpVersion)
+	assert.False(t, r.KeepAlive())
+
+	// Test: Malformed status lines
+	for _, line := range []string{"HTTP/1.1", "HTTP/1.1 20 OK", "HTTP/1.1 2000 OK", "HTTP/1.1 2x0 OK", "HTTPS/1.1 200 OK", "200 OK"} {
+		_, err = ResponseFromReader(strings.NewReader(line + "\r\n\r\n"))
+		assert.ErrorIs(t, err, ErrMalformedStatusLine, line)
+	}
+	_, err = ResponseFromReader(strings.NewReader("HTTP/2 200 OK\r\n\r\n"))
+	assert.ErrorIs(t, err, ErrUnsupportedVersion)
+	_, err = ResponseFromReader(strings.NewReader("HTTP/1.1 099 Early\r\n\r\n"))
+	assert.ErrorIs(t, err, ErrInvalidStatusCode)
+
+	// Test: Status line too long
+	_, err = ResponseFromReader(strings.NewReader("HTTP/1.1 200 " + strings.Repeat("a", maxStatusLineLength) + "\r\n\r\n"))
+	assert.ErrorIs(t, err, ErrStatusLineTooLong)
+}
+
+func TestResponseBody(t *testing.T) {
+	// Test: Body of declared length
+	reader := &chunkReader{
+		data:            "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 13\r\n\r\nhello world!\n",
+		numBytesPerRead: 3,
+	}
+	r, err := ResponseFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "text/plain", r.Headers.Get("Content-Type"))
+	assert.Equal(t, "hello world!\n", string(r.Body))
+	assert.True(t, r.KeepAlive())
+
+	// Test: Chunked body with trailers
+	reader = &chunkReader{
+		data: "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nTrailer: X-Count\r\n\r\n" +
+			"5\r\nhello\r\n6\r\n world\r\n0\r\nX-Count: 11\r\n\r\n",
+		numBytesPerRead: 2,
+	}
+	r, err = ResponseFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(r.Body))
+	assert.Equal(t, "11", r.Trailers.Get("X-Count"))
+	assert.True(t, r.KeepAlive())
+
+	// Test: Body running until the connection closes
+	reader = &chunkReader{
+		data:            "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n\r\nuntil the end",
+		numBytesPerRead: 4,
+	}
+	r, err = ResponseFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "until the end", string(r.Body))
+	assert.False(t, r.KeepAlive())
+
+	// Test: Responses without a body
+	for _, raw := range []string{
+		"HTTP/1.1 204 No Content\r\nContent-Length: 5\r\n\r\n",
+		"HTTP/1.1 304 Not Modified\r\nContent-Length: 5\r\n\r\n",
+		"HTTP/1.1 100 Continue\r\n\r\n",
+	} {
+		r, err = ResponseFromReader(strings.NewReader(raw + "extra"))
+		require.NoError(t, err, raw)
+		assert.Empty(t, r.Body, raw)
+	}
+	r, err = NewReader(strings.NewReader("HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\n")).ReadResponse("HEAD")
+	require.NoError(t, err)
+	assert.Empty(t, r.Body)
+	assert.Equal(t, "5", r.Headers.Get("Content-Length"))
+
+	// Test: Short body
+	_, err = ResponseFromReader(strings.NewReader("HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nshort"))
+	assert.ErrorIs(t, err, ErrIncompleteResponse)
+	_, err = ResponseFromReader(strings.NewReader("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhel"))
+	assert.ErrorIs(t, err, ErrIncompleteResponse)
+
+	// Test: Invalid framing
+	_, err = ResponseFromReader(strings.NewReader("HTTP/1.1 200 OK\r\nContent-Length: abc\r\n\r\n"))
+	assert.ErrorIs(t, err, ErrInvalidContentLength)
+	_, err = ResponseFromReader(strings.NewReader("HTTP/1.1 200 OK\r\nContent-Length: 3\r\nTransfer-Encoding: chunked\r\n\r\n"))
+	assert.ErrorIs(t, err, ErrConflictingFraming)
+}
+
+func TestReadResponses(t *testing.T) {
+	// Test: Consecutive responses on one connection
+	reader := NewReader(&chunkReader{
+		data: "HTTP/1.1 200 OK\r\nContent-Length: 3\r\n\r\none" +
+			"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n3\r\ntwo\r\n0\r\n\r\n" +
+			"HTTP/1.1 404 Not Found\r\nContent-Length: 5\r\n\r\nthree",
+		numBytesPerRead: 7,
+	})
+	for _, want := range []string{"one", "two", "three"} {
+		r, err := reader.ReadResponse("GET")
+		require.NoError(t, err)
+		assert.Equal(t, want, string(r.Body))
+	}
+	_, err := reader.ReadResponse("GET")
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestRoundTrip(t *testing.T) {
+	// Test: Responses written by Writer parse back
+	var buf bytes.Buffer
+	w := newTestWriter(&buf, WithServer("httpfromtcp"))
+	w.Header().Set("Content-Type", "text/plain")
+	_, err := io.WriteString(w, "small body")
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+
+	w = newTestWriter(&buf)
+	body, err := w.ChunkedBody()
+	require.NoError(t, err)
+	body.Trailer("X-Done", func() string { return "yes" })
+	large := strings.Repeat("abcdefgh", maxBufferedBody)
+	_, err = io.WriteString(body, large)
+	require.NoError(t, err)
+	require.NoError(t, body.Close())
+	require.NoError(t, w.Finish())
+
+	reader := NewReader(&buf)
+	r, err := reader.ReadResponse("GET")
+	require.NoError(t, err)
+	assert.Equal(t, StatusOK, r.StatusLine.StatusCode)
+	assert.Equal(t, "httpfromtcp", r.Headers.Get("Server"))
+	assert.Equal(t, "small body", string(r.Body))
+	date, ok, err := r.Headers.Time("Date")
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, testTime, date)
+
+	r, err = reader.ReadResponse("GET")
+	require.NoError(t, err)
+	assert.Equal(t, large, string(r.Body))
+	assert.Equal(t, "yes", r.Trailers.Get("X-Done"))
+	assert.Equal(t, []string{"X-Done"}, r.Headers.Values("Trailer"))
+	assert.Equal(t, 0, buf.Len())
+
+	// Test: Headers survive the trip in order
+	buf.Reset()
+	h := headers.NewHeaders()
+	h.Add("Set-Cookie", "a=1")
+	h.Add("X-Other", "x")
+	h.Add("Set-Cookie", "b=2")
+	h.SetContentLength(0)
+	require.NoError(t, WriteStatusLine(&buf, StatusFound))
+	require.NoError(t, WriteHeaders(&buf, h))
+	r, err = ResponseFromReader(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, "Found", r.StatusLine.ReasonPhrase)
+	var fields []string
+	for name, value := range r.Headers.All() {
+		fields = append(fields, name+": "+value)
+	}
+	assert.Equal(t, []string{"Set-Cookie: a=1", "X-Other: x", "Set-Cookie: b=2", "Content-Length: 0"}, fields)
+}
+
+func TestStreamResponseBody(t *testing.T) {
+	stream := ParseOptions{StreamBody: true}
+
+	// Test: Response returned before the body arrives
+	source := &chunkReader{
+		data:            "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello",
+		numBytesPerRead: 1,
+	}
+	r, err := NewReaderWithOptions(source, stream).ReadResponse("GET")
+	require.NoError(t, err)
+	assert.Less(t, source.pos, len(source.data))
+	assert.Empty(t, r.Body)
+	body, err := io.ReadAll(r.BodyReader)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+
+	// Test: Chunked body with trailers, read in small pieces
+	reader := NewReaderWithOptions(&chunkReader{
+		data: "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n" +
+			"5\r\nhello\r\n7\r\n world!\r\n0\r\nX-Count: 2\r\n\r\n",
+		numBytesPerRead: 4,
+	}, stream)
+	r, err = reader.ReadResponse("GET")
+	require.NoError(t, err)
+	body, err = io.ReadAll(iotest.OneByteReader(r.BodyReader))
+	require.NoError(t, err)
+	assert.Equal(t, "hello world!", string(body))
+	assert.Equal(t, "2", r.Trailers.Get("X-Count"))
+
+	// Test: Body running until the connection closes
+	r, err = NewReaderWithOptions(&chunkReader{
+		data:            "HTTP/1.1 200 OK\r\n\r\nuntil the end",
+		numBytesPerRead: 3,
+	}, stream).ReadResponse("GET")
+	require.NoError(t, err)
+	body, err = io.ReadAll(r.BodyReader)
+	require.NoError(t, err)
+	assert.Equal(t, "until the end", string(body))
+
+	// Test: Next response needs the body to be read or discarded
+	reader = NewReaderWithOptions(&chunkReader{
+		data: "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello" +
+			"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nhi\r\n0\r\n\r\n" +
+			"HTTP/1.1 204 No Content\r\n\r\n",
+		numBytesPerRead: 7,
+	}, stream)
+	_, err = reader.ReadResponse("GET")
+	require.NoError(t, err)
+	_, err = reader.ReadResponse("GET")
+	assert.ErrorIs(t, err, ErrUnreadBody)
+	require.NoError(t, reader.DiscardBody(100))
+	r, err = reader.ReadResponse("GET")
+	require.NoError(t, err)
+	require.NoError(t, r.BodyReader.Close())
+	_, err = r.BodyReader.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, ErrBodyClosed)
+	assert.ErrorIs(t, reader.DiscardBody(1), ErrUnreadBody)
+	reader = NewReaderWithOptions(strings.NewReader("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nhi"+
+		"HTTP/1.1 204 No Content\r\n\r\n"), stream)
+	_, err = reader.ReadResponse("GET")
+	require.NoError(t, err)
+	require.NoError(t, reader.DiscardBody(100))
+	r, err = reader.ReadResponse("GET")
+	require.NoError(t, err)
+	assert.Equal(t, StatusNoContent, r.StatusLine.StatusCode)
+}
@@ -4,16 +4,27 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"time"
 
 	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/stream"
 )
 
-type StatusCode int
-
-const (
-	StatusOK                  StatusCode = 200
-	StatusBadRequest          StatusCode = 400
-	StatusInternalServerError StatusCode = 500
+// maxBufferedBody is how much of a body without a declared length is held
+// back in the hope that it ends before the limit, so a Content-Length can be
+// sent for it. Longer bodies are sent chunked.
+const maxBufferedBody = 4 << 10
+
+// copyBufferSize is the size of the buffer ReadFrom copies through.
+const copyBufferSize = 32 << 10
+
+var (
+	// ErrBodyOverrun is returned by writes going past the declared
+	// Content-Length. Nothing of such a write is sent.
+	ErrBodyOverrun = stream.ErrBodyOverrun
+	// ErrBodyUnderrun is returned by Finish when fewer bytes were written
+	// than the declared Content-Length.
+	ErrBodyUnderrun = stream.ErrBodyUnderrun
 )
 
 type writerState int
@@ -29,86 +40,518 @@ const (
 type Writer struct {
 	w     io.Writer
 	state writerState
+
+	// closeAfter is set when the headers ask for the connection to be
+	// closed or don't frame the body, so its end is only known on close
+	closeAfter bool
+	// declaredLength is the length the headers promise for the body, or
+	// -1 when its end is found some other way
+	declaredLength int64
+
+	statusCode   StatusCode
+	bytesWritten int
+
+	// header holds the fields set through Header, sent by WriteHeader or
+	// added to those passed to WriteHeaders
+	header *headers.Headers
+
+	// pending holds headers declaring no length while the body is
+	// buffered in body, until Finish or the buffer filling up picks the
+	// framing
+	pending *headers.Headers
+	body    []byte
+	// chunked is set while the body is sent chunked and the last chunk
+	// is still to be written
+	chunked bool
+	// trailers holds the canonical names announced by the Trailer header
+	trailers map[string]bool
+	// chunkedBody is the writer ChunkedBody returned before the response
+	// started, whose body and trailers WriteHeader declares
+	chunkedBody *ChunkedWriter
+
+	now    func() time.Time
+	server string
+	// head is set for a response to HEAD, which is sent without its body
+	head bool
 }
 
-func NewWriter(w io.Writer) *Writer {
-	return &Writer{
-		w:     w,
-		state: writerStateInitial,
+// Option configures a Writer.
+type Option func(*Writer)
+
+// WithServer makes the writer add a Server header with value to responses
+// that don't set one.
+func WithServer(value string) Option {
+	return func(w *Writer) {
+		w.server = value
 	}
 }
 
-func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
-	if w.state != writerStateInitial {
-		return errors.New("WriteStatusLine must be called first")
+// WithClock sets the function giving the time sent in the Date header.
+func WithClock(now func() time.Time) Option {
+	return func(w *Writer) {
+		w.now = now
 	}
+}
 
-	var reasonPhrase string
-	switch statusCode {
-	case StatusOK:
-		reasonPhrase = "OK"
-	case StatusBadRequest:
-		reasonPhrase = "Bad Request"
-	case StatusInternalServerError:
-		reasonPhrase = "Internal Server Error"
-	default:
-		reasonPhrase = ""
+// WithMethod tells the writer the method of the request it responds to. A
+// response to HEAD is sent with the headers the same request with GET would
+// get, Content-Length included, but whatever is written to its body is
+// dropped.
+func WithMethod(method string) Option {
+	return func(w *Writer) {
+		w.head = method == "HEAD"
+	}
+}
+
+// NewWriter returns a Writer for a response written to w. It adds a Date
+// header to the response, and a Content-Length to bodies small enough to be
+// buffered when the handler declares neither a length nor chunked encoding.
+// The response is only complete once Finish is called.
+func NewWriter(w io.Writer, options ...Option) *Writer {
+	writer := &Writer{
+		w:              w,
+		state:          writerStateInitial,
+		declaredLength: -1,
+		header:         headers.NewHeaders(),
+		now:            time.Now,
+	}
+	for _, option := range options {
+		option(writer)
 	}
+	return writer
+}
 
-	var err error
-	if reasonPhrase != "" {
-		_, err = fmt.Fprintf(w.w, "HTTP/1.1 %d %s\r\n", statusCode, reasonPhrase)
-	} else {
-		_, err = fmt.Fprintf(w.w, "HTTP/1.1 %d\r\n", statusCode)
+func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
+	if w.state != writerStateInitial {
+		return errors.New("WriteStatusLine must be called first")
 	}
 
+	err := WriteStatusLine(w.w, statusCode)
 	if err != nil {
 		return err
 	}
 
+	w.statusCode = statusCode
 	w.state = writerStateStatusLineWritten
 	return nil
 }
 
-func (w *Writer) WriteHeaders(headers headers.Headers) error {
+// Header returns the header fields of the response, which handlers and
+// middleware may change until the headers are sent. They are sent by
+// WriteHeader, and added to the fields passed to WriteHeaders when those
+// don't have them.
+func (w *Writer) Header() *headers.Headers {
+	return w.header
+}
+
+// HeadersSent reports whether the header section has been written, after
+// which changes to Header are no longer part of the response.
+func (w *Writer) HeadersSent() bool {
+	return w.state >= writerStateHeadersWritten
+}
+
+// WriteHeader sends the status line for statusCode followed by the fields in
+// Header, declaring a chunked body if ChunkedBody was called. Write calls it
+// with StatusOK if the handler hasn't started the response, and Finish does
+// the same for a handler that wrote nothing.
+func (w *Writer) WriteHeader(statusCode StatusCode) error {
+	if w.state != writerStateInitial {
+		return errors.New("WriteHeader called after the response started")
+	}
+	h := w.header.Clone()
+	if w.chunkedBody != nil {
+		h.Del("Content-Length")
+		h.Set("Transfer-Encoding", "chunked")
+		for _, t := range w.chunkedBody.trailers {
+			h.Add("Trailer", t.name)
+		}
+	}
+	// check everything first so a bad field doesn't leave a lone status line
+	if !statusCode.Valid() {
+		return fmt.Errorf("%w: %d", ErrInvalidStatusCode, int(statusCode))
+	}
+	if err := h.Validate(); err != nil {
+		return err
+	}
+
+	if err := w.WriteStatusLine(statusCode); err != nil {
+		return err
+	}
+	return w.WriteHeaders(h)
+}
+
+// implicitHeaders sends the status line and headers of a response the
+// handler hasn't started. A response whose headers are still missing after
+// WriteStatusLine is left alone, the handler meant to send fields of its own.
+func (w *Writer) implicitHeaders() error {
+	if w.state != writerStateInitial {
+		return nil
+	}
+	return w.WriteHeader(StatusOK)
+}
+
+// StatusCode returns the status code of the response, or 0 if the status
+// line hasn't been written yet.
+func (w *Writer) StatusCode() StatusCode {
+	return w.statusCode
+}
+
+// BytesWritten returns the number of body bytes written so far, not counting
+// chunked encoding framing.
+func (w *Writer) BytesWritten() int {
+	return w.bytesWritten
+}
+
+// WriteHeaders sends the header fields, adding those set through Header that h
+// doesn't have, and Date and Server if they are missing. h may be nil when
+// there are no fields of its own. When h declares a Content-Length or a
+// Transfer-Encoding, the framing fields set through Header are left out, and
+// a chunked body is never sent with a Content-Length. When the fields declare
+// neither, they are held back until the body shows which one to use.
+func (w *Writer) WriteHeaders(h *headers.Headers) error {
 	if w.state != writerStateStatusLineWritten {
 		return errors.New("WriteHeaders must be called after WriteStatusLine")
 	}
+	if h == nil {
+		h = headers.NewHeaders()
+	}
 
-	for key, value := range headers {
-		_, err := fmt.Fprintf(w.w, "%s: %s\r\n", key, value)
-		if err != nil {
-			return err
+	// fields framing the body come from one place, so those set through
+	// Header give way when h declares a framing of its own
+	framed := h.Has("Content-Length") || h.Has("Transfer-Encoding")
+	merged := h.Clone()
+	for name, value := range w.header.All() {
+		if h.Has(name) || (framed && framingFields[name]) {
+			continue
 		}
+		merged.Add(name, value)
+	}
+	h = merged
+	if !h.Has("Date") {
+		h.SetTime("Date", w.now())
+	}
+	if w.server != "" && !h.Has("Server") {
+		h.Set("Server", w.server)
 	}
-	_, err := fmt.Fprintf(w.w, "\r\n")
+	if err := h.Validate(); err != nil {
+		return err
+	}
+	trailers, err := declaredTrailers(h)
 	if err != nil {
 		return err
 	}
+	w.trailers = trailers
 
+	contentLength, err := h.ContentLength()
+	if err == nil && contentLength == -1 && !h.Has("Transfer-Encoding") && bodyAllowed(w.statusCode) {
+		w.pending = h
+		w.state = writerStateHeadersWritten
+		return nil
+	}
+
+	err = w.sendHeaders(h)
+	if err != nil {
+		return err
+	}
 	w.state = writerStateHeadersWritten
 	return nil
 }
 
+// sendHeaders writes the header section and notes how the body is framed.
+func (w *Writer) sendHeaders(h *headers.Headers) error {
+	w.pending = nil
+	if h.HasToken("Transfer-Encoding", "chunked") {
+		// a message can't declare both, and the body is sent chunked
+		h.Del("Content-Length")
+	}
+	if !bodyAllowed(w.statusCode) {
+		// the response ends with its headers, so fields framing a body
+		// would have the client wait for one
+		h.Del("Transfer-Encoding")
+		h.Del("Trailer")
+		w.trailers = nil
+	}
+	err := WriteHeaders(w.w, h)
+	if err != nil {
+		return err
+	}
+
+	contentLength, err := h.ContentLength()
+	if err != nil {
+		// the client can't trust the length either
+		contentLength = -1
+	}
+	w.chunked = h.HasToken("Transfer-Encoding", "chunked")
+	if !bodyAllowed(w.statusCode) {
+		contentLength = 0
+	}
+	w.closeAfter = h.HasToken("Connection", "close") || (contentLength == -1 && !w.chunked)
+	w.declaredLength = contentLength
+	if w.head {
+		// the headers describe the body a GET would get, which is
+		// written to nowhere and may be left short
+		w.w = headBody{w.w}
+		w.declaredLength = -1
+	}
+	return nil
+}
+
+// headBody stands in for the connection once the headers of a response to
+// HEAD are sent. It drops the body and its chunked framing, and passes Flush
+// through.
+type headBody struct {
+	w io.Writer
+}
+
+func (b headBody) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (b headBody) Flush() error {
+	if f, ok := b.w.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// framingFields are the header fields describing how the body is framed.
+var framingFields = map[string]bool{
+	"Content-Length":    true,
+	"Transfer-Encoding": true,
+	"Trailer":           true,
+}
+
+// bodyAllowed reports whether a response with statusCode may have a body.
+func bodyAllowed(statusCode StatusCode) bool {
+	return statusCode >= 200 && statusCode != StatusNoContent && statusCode != StatusNotModified
+}
+
+// Finish completes the response after the handler is done with it. Headers
+// still held back are sent with a Content-Length for the buffered body, and a
+// chunked body gets its last chunk, or the empty line ending it when the
+// handler called WriteChunkedBodyDone without WriteTrailers. A body shorter
+// than its declared Content-Length can't be completed, so Finish returns
+// ErrBodyUnderrun and the connection must be closed. A response the handler
+// didn't start is sent as an empty 200. Everything is then flushed to the
+// client. The server calls it once the handler returns.
+func (w *Writer) Finish() error {
+	err := w.finish()
+	if flushErr := w.flush(); err == nil {
+		err = flushErr
+	}
+	return err
+}
+
+func (w *Writer) finish() error {
+	if err := w.implicitHeaders(); err != nil {
+		return err
+	}
+	if w.pending != nil {
+		h := w.pending
+		h.SetContentLength(int64(len(w.body)))
+		if err := w.sendHeaders(h); err != nil {
+			return err
+		}
+		body := w.body
+		w.body = nil
+		if _, err := w.w.Write(body); err != nil {
+			return err
+		}
+	}
+	switch w.state {
+	case writerStateHeadersWritten:
+		// nothing more can be written to the body
+		w.state = writerStateBodyWritten
+		if w.chunked {
+			w.chunked = false
+			_, err := io.WriteString(w.w, "0\r\n\r\n")
+			return err
+		}
+	case writerStateChunkedBodyDone:
+		// the last chunk went out without the trailers ending the message
+		w.state = writerStateBodyWritten
+		_, err := io.WriteString(w.w, "\r\n")
+		return err
+	}
+	if w.declaredLength > int64(w.bytesWritten) {
+		w.closeAfter = true
+		return fmt.Errorf("%w: wrote %d of %d bytes", ErrBodyUnderrun, w.bytesWritten, w.declaredLength)
+	}
+	return nil
+}
+
+// KeepAlive reports whether the response has been written completely and is
+// framed so the client can find its end, meaning another response may follow
+// on the same connection.
+func (w *Writer) KeepAlive() bool {
+	if w.closeAfter || w.pending != nil || w.chunked {
+		return false
+	}
+	switch w.state {
+	case writerStateHeadersWritten, writerStateBodyWritten:
+		return w.declaredLength == -1 || int64(w.bytesWritten) == w.declaredLength
+	default:
+		return false
+	}
+}
+
+// Write writes p as part of the body, making Writer an io.Writer. It may be
+// called any number of times, the first call sending the status line and
+// headers through WriteHeader(StatusOK) if the handler hasn't started the
+// response.
+// Writes past the declared Content-Length fail with ErrBodyOverrun without
+// sending anything, and a body declared chunked has each write sent as a
+// chunk.
+func (w *Writer) Write(p []byte) (int, error) {
+	if err := w.implicitHeaders(); err != nil {
+		return 0, err
+	}
+	if w.state != writerStateHeadersWritten {
+		return 0, errors.New("Write must be called after WriteHeaders and before the body is finished")
+	}
+	if w.declaredLength >= 0 && int64(w.bytesWritten+len(p)) > w.declaredLength {
+		return 0, fmt.Errorf("%w: %d bytes after %d of %d", ErrBodyOverrun,
+			len(p), w.bytesWritten, w.declaredLength)
+	}
+	return w.writeBody(p)
+}
+
+// WriteBody is Write, kept for handlers written against it.
 func (w *Writer) WriteBody(p []byte) (int, error) {
+	return w.Write(p)
+}
+
+// ReadFrom writes everything read from r until io.EOF as the body, making
+// Writer an io.ReaderFrom. A body of declared length is handed to the
+// underlying writer's io.Copy as is, so a connection can send a file without
+// copying it through user space.
+// If r holds more than the declared length, ReadFrom stops there and returns
+// ErrBodyOverrun.
+func (w *Writer) ReadFrom(r io.Reader) (int64, error) {
+	if err := w.implicitHeaders(); err != nil {
+		return 0, err
+	}
 	if w.state != writerStateHeadersWritten {
-		return 0, errors.New("WriteBody must be called after WriteHeaders")
+		return 0, errors.New("ReadFrom must be called after WriteHeaders and before the body is finished")
 	}
 
-	n, err := w.w.Write(p)
-	if err != nil {
+	if w.pending == nil && !w.chunked && w.declaredLength >= 0 {
+		remaining := w.declaredLength - int64(w.bytesWritten)
+		n, err := io.Copy(w.w, io.LimitReader(r, remaining))
+		w.bytesWritten += int(n)
+		if err != nil || n < remaining {
+			return n, err
+		}
+		// a byte more than the declared length means r was too long
+		var extra [1]byte
+		if m, _ := io.ReadFull(r, extra[:]); m > 0 {
+			return n, fmt.Errorf("%w: more than %d bytes to copy", ErrBodyOverrun, w.declaredLength)
+		}
+		return n, nil
+	}
+
+	buf := make([]byte, copyBufferSize)
+	var total int64
+	for {
+		nr, err := r.Read(buf)
+		if nr > 0 {
+			nw, werr := w.Write(buf[:nr])
+			total += int64(nw)
+			if werr != nil {
+				return total, werr
+			}
+		}
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+func (w *Writer) writeBody(p []byte) (int, error) {
+	if w.pending != nil {
+		if len(w.body)+len(p) <= maxBufferedBody {
+			w.body = append(w.body, p...)
+			w.bytesWritten += len(p)
+			return len(p), nil
+		}
+
+		// too long to wait for its end, send what we have chunked
+		if err := w.startChunked(); err != nil {
+			return 0, err
+		}
+	}
+	if w.chunked {
+		n, err := w.writeChunk(p)
+		w.bytesWritten += n
 		return n, err
 	}
 
-	w.state = writerStateBodyWritten
-	return n, nil
+	n, err := w.w.Write(p)
+	w.bytesWritten += n
+	return n, err
+}
+
+// startChunked sends the held back headers with chunked encoding, followed by
+// the body buffered so far as the first chunk.
+func (w *Writer) startChunked() error {
+	w.pending.Set("Transfer-Encoding", "chunked")
+	if err := w.sendHeaders(w.pending); err != nil {
+		return err
+	}
+	body := w.body
+	w.body = nil
+	_, err := w.writeChunk(body)
+	return err
+}
+
+// Flush sends everything written so far to the client, for handlers
+// streaming a response that comes out over time. A response not started yet
+// is started with WriteHeader(StatusOK), and headers held back for a body of
+// unknown length are sent with chunked encoding, since its end isn't known
+// yet. The underlying writer is flushed if it has a Flush method, like the
+// buffered writer the server puts in front of each connection.
+func (w *Writer) Flush() error {
+	if err := w.implicitHeaders(); err != nil {
+		return err
+	}
+	if w.pending != nil {
+		if err := w.startChunked(); err != nil {
+			return err
+		}
+	}
+	return w.flush()
+}
+
+// flush flushes the underlying writer if it buffers.
+func (w *Writer) flush() error {
+	if f, ok := w.w.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
 }
 
 func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
 	if w.state != writerStateHeadersWritten {
 		return 0, errors.New("WriteChunkedBody must be called after WriteHeaders")
 	}
+	if w.pending != nil {
+		// headers held back for a body of unknown length go out
+		// declaring the chunked encoding the body is sent with
+		if err := w.startChunked(); err != nil {
+			return 0, err
+		}
+	}
 
+	n, err := w.writeChunk(p)
+	w.bytesWritten += n
+	return n, err
+}
+
+// writeChunk writes p as a single chunk, returning how much of p was written.
+func (w *Writer) writeChunk(p []byte) (int, error) {
 	if len(p) == 0 {
 		return 0, nil
 	}
@@ -138,6 +581,11 @@ func (w *Writer) WriteChunkedBodyDone() (int, error) {
 	if w.state != writerStateHeadersWritten {
 		return 0, errors.New("WriteChunkedBodyDone must be called after WriteHeaders")
 	}
+	if w.pending != nil {
+		if err := w.startChunked(); err != nil {
+			return 0, err
+		}
+	}
 
 	// Write final chunk marker: 0\r\n
 	// Trailers will be written after this if needed
@@ -146,25 +594,25 @@ func (w *Writer) WriteChunkedBodyDone() (int, error) {
 		return 0, err
 	}
 
+	w.chunked = false
 	w.state = writerStateChunkedBodyDone
 	return 0, nil
 }
 
-func (w *Writer) WriteTrailers(h headers.Headers) error {
+// WriteTrailers writes the trailer fields after WriteChunkedBodyDone, ending
+// the response. Every field must have been announced in the Trailer header
+// and be allowed in trailers, or nothing is written. EndChunkedBody does both
+// steps at once.
+func (w *Writer) WriteTrailers(h *headers.Headers) error {
 	if w.state != writerStateChunkedBodyDone {
 		return errors.New("WriteTrailers must be called after WriteChunkedBodyDone")
 	}
-
-	// Write trailers (formatted just like headers)
-	for key, value := range h {
-		_, err := fmt.Fprintf(w.w, "%s: %s\r\n", key, value)
-		if err != nil {
-			return err
-		}
+	if err := w.checkTrailers(h); err != nil {
+		return err
 	}
 
-	// Write final CRLF after trailers
-	_, err := fmt.Fprintf(w.w, "\r\n")
+	// Trailers are formatted just like headers, ending with a CRLF
+	err := WriteHeaders(w.w, h)
 	if err != nil {
 		return err
 	}
@@ -173,42 +621,28 @@ func (w *Writer) WriteTrailers(h headers.Headers) error {
 	return nil
 }
 
+// WriteStatusLine writes an HTTP/1.1 status line for statusCode, with its
+// reason phrase if it has one. Codes outside 100 to 999 are rejected.
 func WriteStatusLine(w io.Writer, statusCode StatusCode) error {
-	var reasonPhrase string
-	switch statusCode {
-	case StatusOK:
-		reasonPhrase = "OK"
-	case StatusBadRequest:
-		reasonPhrase = "Bad Request"
-	case StatusInternalServerError:
-		reasonPhrase = "Internal Server Error"
-	default:
-		reasonPhrase = ""
-	}
-
-	if reasonPhrase != "" {
-		_, err := fmt.Fprintf(w, "HTTP/1.1 %d %s\r\n", statusCode, reasonPhrase)
-		return err
+	if !statusCode.Valid() {
+		return fmt.Errorf("%w: %d", ErrInvalidStatusCode, int(statusCode))
 	}
-	_, err := fmt.Fprintf(w, "HTTP/1.1 %d\r\n", statusCode)
+	// the space before the reason phrase is required even when it's empty
+	_, err := fmt.Fprintf(w, "HTTP/1.1 %d %s\r\n", statusCode, StatusText(statusCode))
 	return err
 }
 
-func GetDefaultHeaders(contentLen int) headers.Headers {
+func GetDefaultHeaders(contentLen int) *headers.Headers {
 	h := headers.NewHeaders()
-	h.Set("Content-Length", fmt.Sprintf("%d", contentLen))
+	h.SetContentLength(int64(contentLen))
 	h.Set("Connection", "close")
 	h.Set("Content-Type", "text/plain")
 	return h
 }
 
-func WriteHeaders(w io.Writer, headers headers.Headers) error {
-	for key, value := range headers {
-		_, err := fmt.Fprintf(w, "%s: %s\r\n", key, value)
-		if err != nil {
-			return err
-		}
-	}
-	_, err := fmt.Fprintf(w, "\r\n")
-	return err
+// WriteHeaders writes the header fields in order, followed by the empty line
+// ending the header section. Nothing is written if a field name or value is
+// invalid, which keeps values from injecting fields of their own.
+func WriteHeaders(w io.Writer, headers *headers.Headers) error {
+	return headers.Write(w)
 }
@@ -0,0 +1,686 @@
+package response
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testTime = time.Date(2024, time.March, 1, 12, 30, 0, 0, time.UTC)
+
+const testDate = "Date: Fri, 01 Mar 2024 12:30:00 GMT\r\n"
+
+func newTestWriter(buf io.Writer, options ...Option) *Writer {
+	options = append(options, WithClock(func() time.Time { return testTime }))
+	return NewWriter(buf, options...)
+}
+
+func TestAutomaticHeaders(t *testing.T) {
+	// Test: Content-Length added to a small body
+	var buf bytes.Buffer
+	w := newTestWriter(&buf, WithServer("httpfromtcp"))
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "text/plain")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err := w.WriteBody([]byte("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", buf.String())
+	assert.False(t, w.KeepAlive())
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n"+testDate+
+		"Server: httpfromtcp\r\nContent-Length: 5\r\n\r\nhello", buf.String())
+	assert.True(t, w.KeepAlive())
+	assert.False(t, h.Has("Date"), "the handler's headers are left alone")
+
+	// Test: Fields set by the handler win
+	buf.Reset()
+	w = newTestWriter(&buf, WithServer("httpfromtcp"))
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	h = headers.NewHeaders()
+	h.Set("Date", "Thu, 29 Feb 2024 00:00:00 GMT")
+	h.Set("Server", "custom")
+	h.SetContentLength(2)
+	require.NoError(t, w.WriteHeaders(h))
+	_, err = w.WriteBody([]byte("ok"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nDate: Thu, 29 Feb 2024 00:00:00 GMT\r\nServer: custom\r\n"+
+		"Content-Length: 2\r\n\r\nok", buf.String())
+
+	// Test: No body gets a zero Content-Length
+	buf.Reset()
+	w = newTestWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusNotFound))
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 404 Not Found\r\n"+testDate+"Content-Length: 0\r\n\r\n", buf.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: Responses that can't have a body get no Content-Length
+	buf.Reset()
+	w = newTestWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusNoContent))
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 204 No Content\r\n"+testDate+"\r\n", buf.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: A body too large to buffer is chunked
+	buf.Reset()
+	w = newTestWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	body := strings.Repeat("a", maxBufferedBody+1)
+	_, err = w.WriteBody([]byte(body))
+	require.NoError(t, err)
+	assert.False(t, w.KeepAlive())
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n"+testDate+"Transfer-Encoding: chunked\r\n\r\n"+
+		"1001\r\n"+body+"\r\n0\r\n\r\n", buf.String())
+	assert.True(t, w.KeepAlive())
+	assert.Equal(t, len(body), w.BytesWritten())
+}
+
+func TestBodyWrites(t *testing.T) {
+	// Test: Several writes of a declared length
+	var buf bytes.Buffer
+	w := newTestWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	h := headers.NewHeaders()
+	h.SetContentLength(11)
+	require.NoError(t, w.WriteHeaders(h))
+	_, err := io.WriteString(w, "hello")
+	require.NoError(t, err)
+	_, err = fmt.Fprintf(w, " %s", "world")
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 11\r\n"+testDate+"\r\nhello world", buf.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: Writes past the declared length fail without sending anything
+	buf.Reset()
+	w = newTestWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	h = headers.NewHeaders()
+	h.SetContentLength(4)
+	require.NoError(t, w.WriteHeaders(h))
+	_, err = w.Write([]byte("abc"))
+	require.NoError(t, err)
+	n, err := w.Write([]byte("de"))
+	assert.ErrorIs(t, err, ErrBodyOverrun)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, 3, w.BytesWritten())
+
+	// Test: A short body is reported by Finish and closes the connection
+	assert.ErrorIs(t, w.Finish(), ErrBodyUnderrun)
+	assert.False(t, w.KeepAlive())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 4\r\n"+testDate+"\r\nabc", buf.String())
+
+	// Test: Responses that can't have a body reject writes
+	buf.Reset()
+	w = newTestWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusNoContent))
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	_, err = w.Write([]byte("x"))
+	assert.ErrorIs(t, err, ErrBodyOverrun)
+
+	// Test: An encoder writing to a body of unknown length
+	buf.Reset()
+	w = newTestWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	h = headers.NewHeaders()
+	h.Set("Content-Type", "application/json")
+	require.NoError(t, w.WriteHeaders(h))
+	require.NoError(t, json.NewEncoder(w).Encode(map[string]int{"a": 1}))
+	require.NoError(t, json.NewEncoder(w).Encode(map[string]int{"b": 2}))
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Type: application/json\r\n"+testDate+
+		"Content-Length: 16\r\n\r\n{\"a\":1}\n{\"b\":2}\n", buf.String())
+
+	// Test: Writes to a body declared chunked are sent as chunks
+	buf.Reset()
+	w = newTestWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	h = headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err = io.WriteString(w, "abc")
+	require.NoError(t, err)
+	_, err = io.WriteString(w, "de")
+	require.NoError(t, err)
+	assert.False(t, w.KeepAlive())
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n"+testDate+"\r\n"+
+		"3\r\nabc\r\n2\r\nde\r\n0\r\n\r\n", buf.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: Writes after Finish are rejected
+	_, err = w.Write([]byte("late"))
+	assert.Error(t, err)
+
+	// Test: Explicit chunks after headers held back for an unknown length
+	buf.Reset()
+	w = newTestWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	_, err = io.WriteString(w, "xy")
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBody([]byte("abc"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	require.NoError(t, w.WriteTrailers(headers.NewHeaders()))
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n"+testDate+"Transfer-Encoding: chunked\r\n\r\n"+
+		"2\r\nxy\r\n3\r\nabc\r\n0\r\n\r\n", buf.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: Last chunk right after headers held back
+	buf.Reset()
+	w = newTestWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n"+testDate+"Transfer-Encoding: chunked\r\n\r\n0\r\n\r\n", buf.String())
+}
+
+func TestReadFrom(t *testing.T) {
+	// Test: io.Copy into a body of declared length
+	var buf bytes.Buffer
+	w := newTestWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	h := headers.NewHeaders()
+	h.SetContentLength(5)
+	require.NoError(t, w.WriteHeaders(h))
+	n, err := io.Copy(w, strings.NewReader("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), n)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n"+testDate+"\r\nhello", buf.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: Copying more than the declared length stops at it
+	buf.Reset()
+	w = newTestWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	h = headers.NewHeaders()
+	h.SetContentLength(3)
+	require.NoError(t, w.WriteHeaders(h))
+	n, err = w.ReadFrom(strings.NewReader("hello"))
+	assert.ErrorIs(t, err, ErrBodyOverrun)
+	assert.Equal(t, int64(3), n)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 3\r\n"+testDate+"\r\nhel", buf.String())
+
+	// Test: Copying a long body of unknown length
+	buf.Reset()
+	w = newTestWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	body := strings.Repeat("a", maxBufferedBody) + strings.Repeat("b", maxBufferedBody)
+	n, err = io.Copy(w, iotest.HalfReader(strings.NewReader(body)))
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(body)), n)
+	require.NoError(t, w.Finish())
+	assert.True(t, w.KeepAlive())
+
+	raw := buf.String()
+	head, chunks, ok := strings.Cut(raw, "\r\n\r\n")
+	require.True(t, ok)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n"+testDate+"Transfer-Encoding: chunked", head)
+	r := request.NewReader(strings.NewReader("POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n" + chunks))
+	req, err := r.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, body, string(req.Body))
+}
+
+func TestHeadResponses(t *testing.T) {
+	// Test: The handler's Content-Length is sent without the body
+	var buf bytes.Buffer
+	w := newTestWriter(&buf, WithMethod("HEAD"))
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	h := headers.NewHeaders()
+	h.SetContentLength(5)
+	require.NoError(t, w.WriteHeaders(h))
+	n, err := w.Write([]byte("hel"))
+	require.NoError(t, err)
+	assert.Equal(t, 3, n)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n"+testDate+"\r\n", buf.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: A buffered body gives its length
+	buf.Reset()
+	w = newTestWriter(&buf, WithMethod("HEAD"))
+	_, err = io.WriteString(w, "hello")
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n"+testDate+"Content-Length: 5\r\n\r\n", buf.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: A chunked body is left out with its framing and trailers
+	buf.Reset()
+	w = newTestWriter(&buf, WithMethod("HEAD"))
+	cw, err := w.ChunkedBody()
+	require.NoError(t, err)
+	cw.Trailer("X-Count", func() string { return "5" })
+	_, err = io.Copy(cw, strings.NewReader("hello"))
+	require.NoError(t, err)
+	require.NoError(t, cw.Close())
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nTrailer: X-Count\r\n"+testDate+"\r\n", buf.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: Other methods get their body
+	buf.Reset()
+	w = newTestWriter(&buf, WithMethod("GET"))
+	_, err = io.WriteString(w, "hello")
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n"+testDate+"Content-Length: 5\r\n\r\nhello", buf.String())
+}
+
+func TestImplicitHeaders(t *testing.T) {
+	// Test: The first write sends a 200 with the fields set through Header
+	var buf bytes.Buffer
+	w := newTestWriter(&buf)
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Add("Set-Cookie", "a=1")
+	w.Header().Add("Set-Cookie", "b=2")
+	assert.False(t, w.HeadersSent())
+	_, err := io.WriteString(w, "hi")
+	require.NoError(t, err)
+	assert.True(t, w.HeadersSent())
+	assert.Equal(t, StatusOK, w.StatusCode())
+	w.Header().Set("X-Late", "ignored")
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nSet-Cookie: a=1\r\nSet-Cookie: b=2\r\n"+
+		testDate+"Content-Length: 2\r\n\r\nhi", buf.String())
+
+	// Test: WriteHeader with another status
+	buf.Reset()
+	w = newTestWriter(&buf)
+	w.Header().Set("Location", "/next")
+	require.NoError(t, w.WriteHeader(StatusFound))
+	assert.Error(t, w.WriteHeader(StatusOK))
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 302 Found\r\nLocation: /next\r\n"+testDate+"Content-Length: 0\r\n\r\n", buf.String())
+
+	// Test: An invalid field sends nothing
+	buf.Reset()
+	w = newTestWriter(&buf)
+	w.Header().Set("Location", "/next\r\nSet-Cookie: x")
+	assert.ErrorIs(t, w.WriteHeader(StatusFound), headers.ErrInvalidHeaderValue)
+	assert.ErrorIs(t, w.WriteHeader(StatusCode(1000)), ErrInvalidStatusCode)
+	assert.Empty(t, buf.String())
+	assert.False(t, w.HeadersSent())
+
+	// Test: Fields passed to WriteHeaders win over those set through Header
+	buf.Reset()
+	w = newTestWriter(&buf)
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("X-Request-Id", "abc")
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "text/html")
+	h.SetContentLength(0)
+	require.NoError(t, w.WriteHeaders(h))
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Type: text/html\r\nContent-Length: 0\r\n"+
+		"X-Request-Id: abc\r\n"+testDate+"\r\n", buf.String())
+
+	// Test: Framing fields set through Header give way to those passed
+	buf.Reset()
+	w = newTestWriter(&buf)
+	w.Header().SetContentLength(99)
+	w.Header().Set("Trailer", "X-A")
+	w.Header().Set("Content-Type", "text/plain")
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	h = headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err = io.WriteString(w, "hi")
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nContent-Type: text/plain\r\n"+testDate+"\r\n"+
+		"2\r\nhi\r\n0\r\n\r\n", buf.String())
+
+	buf.Reset()
+	w = newTestWriter(&buf)
+	w.Header().Set("Transfer-Encoding", "chunked")
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	h = headers.NewHeaders()
+	h.SetContentLength(2)
+	require.NoError(t, w.WriteHeaders(h))
+	_, err = io.WriteString(w, "hi")
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n"+testDate+"\r\nhi", buf.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: A chunked body is sent without a Content-Length
+	buf.Reset()
+	w = newTestWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	h = headers.NewHeaders()
+	h.SetContentLength(2)
+	h.Set("Transfer-Encoding", "chunked")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err = io.WriteString(w, "hi")
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n"+testDate+"\r\n"+
+		"2\r\nhi\r\n0\r\n\r\n", buf.String())
+	assert.True(t, h.Has("Content-Length"), "the handler's headers are left alone")
+
+	// Test: nil passed to WriteHeaders sends the fields set through Header
+	buf.Reset()
+	w = newTestWriter(&buf)
+	w.Header().Set("Content-Type", "text/plain")
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(nil))
+	_, err = io.WriteString(w, "hi")
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n"+testDate+"Content-Length: 2\r\n\r\nhi", buf.String())
+
+	// Test: A handler that wrote nothing gets an empty 200
+	buf.Reset()
+	w = newTestWriter(&buf)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n"+testDate+"Content-Length: 0\r\n\r\n", buf.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: A body isn't started on headers that failed
+	buf.Reset()
+	w = newTestWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	_, err = w.Write([]byte("x"))
+	assert.Error(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", buf.String())
+	assert.False(t, w.KeepAlive())
+}
+
+func TestFlush(t *testing.T) {
+	// Test: Nothing reaches the connection before Flush
+	var conn bytes.Buffer
+	out := bufio.NewWriter(&conn)
+	w := newTestWriter(out)
+	w.Header().Set("Content-Type", "text/plain")
+	_, err := io.WriteString(w, "first")
+	require.NoError(t, err)
+	assert.Empty(t, conn.String())
+
+	// Test: Flush picks chunked encoding for a body of unknown length
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n"+testDate+
+		"Transfer-Encoding: chunked\r\n\r\n5\r\nfirst\r\n", conn.String())
+
+	// Test: Finish flushes the rest
+	_, err = io.WriteString(w, "second")
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasSuffix(conn.String(), "5\r\nfirst\r\n6\r\nsecond\r\n0\r\n\r\n"), "got %q", conn.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: Flush starts a response with an empty 200
+	conn.Reset()
+	w = newTestWriter(out)
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n"+testDate+"Transfer-Encoding: chunked\r\n\r\n", conn.String())
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n"+testDate+"Transfer-Encoding: chunked\r\n\r\n0\r\n\r\n", conn.String())
+}
+
+// countingWriter counts the writes reaching it, each of which would be a
+// write syscall on a connection.
+type countingWriter struct {
+	writes int
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.writes++
+	return len(p), nil
+}
+
+// BenchmarkWriter writes a chunked response straight to the connection and
+// through a buffer the way the server does, reporting the writes per response.
+func BenchmarkWriter(b *testing.B) {
+	chunk := []byte(strings.Repeat("a", 256))
+	respond := func(out io.Writer) {
+		w := NewWriter(out)
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Transfer-Encoding", "chunked")
+		w.WriteHeader(StatusOK)
+		for range 8 {
+			w.Write(chunk)
+		}
+		w.Finish()
+	}
+
+	b.Run("unbuffered", func(b *testing.B) {
+		var conn countingWriter
+		for i := 0; i < b.N; i++ {
+			respond(&conn)
+		}
+		b.ReportMetric(float64(conn.writes)/float64(b.N), "writes/op")
+	})
+	b.Run("buffered", func(b *testing.B) {
+		var conn countingWriter
+		out := bufio.NewWriterSize(&conn, 4<<10)
+		for i := 0; i < b.N; i++ {
+			respond(out)
+		}
+		b.ReportMetric(float64(conn.writes)/float64(b.N), "writes/op")
+	})
+}
+
+func TestTrailers(t *testing.T) {
+	chunkedHeaders := func(trailer string) *headers.Headers {
+		h := headers.NewHeaders()
+		h.Set("Transfer-Encoding", "chunked")
+		h.Set("Trailer", trailer)
+		return h
+	}
+
+	// Test: Declared trailers end the body in one step
+	var buf bytes.Buffer
+	w := newTestWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(chunkedHeaders("x-checksum, X-Count")))
+	_, err := io.WriteString(w, "abc")
+	require.NoError(t, err)
+	trailers := headers.NewHeaders()
+	trailers.Set("X-Checksum", "123")
+	trailers.Set("X-Count", "3")
+	require.NoError(t, w.EndChunkedBody(trailers))
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nTrailer: x-checksum, X-Count\r\n"+testDate+"\r\n"+
+		"3\r\nabc\r\n0\r\nX-Checksum: 123\r\nX-Count: 3\r\n\r\n", buf.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: Undeclared and prohibited trailers are rejected before writing
+	buf.Reset()
+	w = newTestWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(chunkedHeaders("X-Checksum")))
+	sent := buf.Len()
+	trailers = headers.NewHeaders()
+	trailers.Set("X-Other", "1")
+	assert.ErrorIs(t, w.EndChunkedBody(trailers), ErrUndeclaredTrailer)
+	trailers = headers.NewHeaders()
+	trailers.Set("Content-Length", "3")
+	assert.ErrorIs(t, w.EndChunkedBody(trailers), ErrProhibitedTrailer)
+	assert.Equal(t, sent, buf.Len())
+
+	// Test: WriteTrailers checks them too
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	trailers = headers.NewHeaders()
+	trailers.Set("Authorization", "secret")
+	assert.ErrorIs(t, w.WriteTrailers(trailers), ErrProhibitedTrailer)
+
+	// Test: Finish ends a body left without its trailers
+	assert.False(t, w.KeepAlive())
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\n0\r\n\r\n"), "got %q", buf.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: Prohibited fields can't be announced
+	buf.Reset()
+	w = newTestWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	assert.ErrorIs(t, w.WriteHeaders(chunkedHeaders("X-Checksum, Transfer-Encoding")), ErrProhibitedTrailer)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", buf.String())
+
+	// Test: A body of unknown length is chunked to carry trailers
+	buf.Reset()
+	w = newTestWriter(&buf)
+	w.Header().Set("Trailer", "X-Count")
+	_, err = io.WriteString(w, "abc")
+	require.NoError(t, err)
+	trailers = headers.NewHeaders()
+	trailers.Set("X-Count", "3")
+	require.NoError(t, w.EndChunkedBody(trailers))
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nTrailer: X-Count\r\n"+testDate+"Transfer-Encoding: chunked\r\n\r\n"+
+		"3\r\nabc\r\n0\r\nX-Count: 3\r\n\r\n", buf.String())
+
+	// Test: A body with a declared length can't end chunked
+	buf.Reset()
+	w = newTestWriter(&buf)
+	w.Header().SetContentLength(0)
+	require.NoError(t, w.WriteHeader(StatusOK))
+	assert.Error(t, w.EndChunkedBody(nil))
+}
+
+func TestChunkedWriter(t *testing.T) {
+	// Test: io.Copy into a chunked body with trailers computed on Close
+	var buf bytes.Buffer
+	w := newTestWriter(&buf)
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().SetContentLength(99)
+	body, err := w.ChunkedBody()
+	require.NoError(t, err)
+	var length int64
+	body.Trailer("x-length", func() string { return strconv.FormatInt(length, 10) })
+	body.Trailer("X-Last", func() string { return "yes" })
+	length, err = io.Copy(body, strings.NewReader("hello"))
+	require.NoError(t, err)
+	require.NoError(t, body.Close())
+	require.NoError(t, body.Close())
+	_, err = body.Write([]byte("late"))
+	assert.Error(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nTransfer-Encoding: chunked\r\n"+
+		"Trailer: X-Length\r\nTrailer: X-Last\r\n"+testDate+"\r\n"+
+		"5\r\nhello\r\n0\r\nX-Length: 5\r\nX-Last: yes\r\n\r\n", buf.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: Closing an empty body still sends the headers
+	buf.Reset()
+	w = newTestWriter(&buf)
+	body, err = w.ChunkedBody()
+	require.NoError(t, err)
+	require.NoError(t, body.Close())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n"+testDate+"\r\n0\r\n\r\n", buf.String())
+
+	// Test: A response sent another way isn't chunked
+	buf.Reset()
+	w = newTestWriter(&buf)
+	w.Header().Set("X-Request-Id", "abc")
+	body, err = w.ChunkedBody()
+	require.NoError(t, err)
+	body.Trailer("X-A", func() string { return "1" })
+	assert.False(t, w.Header().Has("Transfer-Encoding"))
+	assert.False(t, w.Header().Has("Trailer"))
+	require.NoError(t, w.WriteStatusLine(StatusInternalServerError))
+	h := headers.NewHeaders()
+	h.SetContentLength(5)
+	require.NoError(t, w.WriteHeaders(h))
+	_, err = io.WriteString(w, "oops\n")
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 500 Internal Server Error\r\nContent-Length: 5\r\nX-Request-Id: abc\r\n"+testDate+"\r\noops\n", buf.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: Trailers after WriteHeaders must have been announced
+	buf.Reset()
+	w = newTestWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	h = headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("Trailer", "X-Declared")
+	require.NoError(t, w.WriteHeaders(h))
+	body, err = w.ChunkedBody()
+	require.NoError(t, err)
+	body.Trailer("X-Undeclared", func() string { return "no" })
+	assert.ErrorIs(t, body.Close(), ErrUndeclaredTrailer)
+
+	// Test: Headers held back can still announce trailers
+	buf.Reset()
+	w = newTestWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	body, err = w.ChunkedBody()
+	require.NoError(t, err)
+	body.Trailer("X-Late", func() string { return "ok" })
+	_, err = io.WriteString(body, "abc")
+	require.NoError(t, err)
+	require.NoError(t, body.Close())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n"+testDate+"Trailer: X-Late\r\nTransfer-Encoding: chunked\r\n\r\n"+
+		"3\r\nabc\r\n0\r\nX-Late: ok\r\n\r\n", buf.String())
+
+	// Test: Responses that can't have a body leave out the chunked framing
+	buf.Reset()
+	w = newTestWriter(&buf)
+	body, err = w.ChunkedBody()
+	require.NoError(t, err)
+	body.Trailer("X-A", func() string { return "1" })
+	require.NoError(t, w.WriteHeader(StatusNoContent))
+	require.NoError(t, body.Close())
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 204 No Content\r\n"+testDate+"\r\n", buf.String())
+	assert.True(t, w.KeepAlive())
+
+	buf.Reset()
+	w = newTestWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusNotModified))
+	h = headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("Trailer", "X-A")
+	h.Set("Etag", `"v1"`)
+	require.NoError(t, w.WriteHeaders(h))
+	body, err = w.ChunkedBody()
+	require.NoError(t, err)
+	trailers := headers.NewHeaders()
+	trailers.Set("X-A", "1")
+	require.NoError(t, w.EndChunkedBody(trailers))
+	require.NoError(t, body.Close())
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 304 Not Modified\r\nEtag: \"v1\"\r\n"+testDate+"\r\n", buf.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: A body with a declared length can't be chunked
+	w = newTestWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	h = headers.NewHeaders()
+	h.SetContentLength(3)
+	require.NoError(t, w.WriteHeaders(h))
+	_, err = w.ChunkedBody()
+	assert.Error(t, err)
+}
@@ -0,0 +1,44 @@
+package response
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatusText(t *testing.T) {
+	assert.Equal(t, "OK", StatusText(StatusOK))
+	assert.Equal(t, "Content Too Large", StatusText(StatusContentTooLarge))
+	assert.Equal(t, "Unprocessable Content", StatusText(422))
+	assert.Equal(t, "Network Authentication Required", StatusText(StatusNetworkAuthenticationRequired))
+	assert.Equal(t, "", StatusText(299))
+
+	assert.True(t, StatusCode(100).Valid())
+	assert.True(t, StatusCode(999).Valid())
+	assert.False(t, StatusCode(99).Valid())
+	assert.False(t, StatusCode(1000).Valid())
+}
+
+func TestWriteStatusLine(t *testing.T) {
+	// Test: Registered code
+	var buf bytes.Buffer
+	require.NoError(t, WriteStatusLine(&buf, StatusBadGateway))
+	assert.Equal(t, "HTTP/1.1 502 Bad Gateway\r\n", buf.String())
+
+	// Test: Unregistered code keeps the space before the empty reason
+	buf.Reset()
+	require.NoError(t, WriteStatusLine(&buf, 299))
+	assert.Equal(t, "HTTP/1.1 299 \r\n", buf.String())
+
+	// Test: Codes without three digits are rejected
+	buf.Reset()
+	w := NewWriter(&buf)
+	assert.ErrorIs(t, w.WriteStatusLine(42), ErrInvalidStatusCode)
+	assert.ErrorIs(t, w.WriteStatusLine(1000), ErrInvalidStatusCode)
+	assert.Empty(t, buf.String())
+	assert.Equal(t, StatusCode(0), w.StatusCode())
+	require.NoError(t, w.WriteStatusLine(StatusTooManyRequests))
+	assert.Equal(t, "HTTP/1.1 429 Too Many Requests\r\n", buf.String())
+}
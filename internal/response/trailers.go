@@ -0,0 +1,117 @@
+package response
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"httpfromtcp/internal/headers"
+)
+
+var (
+	// ErrUndeclaredTrailer is returned for trailer fields the response
+	// didn't announce in its Trailer header.
+	ErrUndeclaredTrailer = errors.New("trailer field not declared in the Trailer header")
+	// ErrProhibitedTrailer is returned for fields that can't be sent in a
+	// trailer section, whether announced or written.
+	ErrProhibitedTrailer = errors.New("field not allowed in trailers")
+)
+
+// prohibitedTrailers are the fields a recipient needs before the body, to
+// frame, route, authenticate or interpret the message, so they can't come
+// after it (RFC 9110, section 6.5.1).
+var prohibitedTrailers = map[string]bool{
+	"Authorization":       true,
+	"Cache-Control":       true,
+	"Connection":          true,
+	"Content-Encoding":    true,
+	"Content-Length":      true,
+	"Content-Range":       true,
+	"Content-Type":        true,
+	"Expect":              true,
+	"Host":                true,
+	"Keep-Alive":          true,
+	"Max-Forwards":        true,
+	"Pragma":              true,
+	"Proxy-Authenticate":  true,
+	"Proxy-Authorization": true,
+	"Proxy-Connection":    true,
+	"Range":               true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Www-Authenticate":    true,
+}
+
+// declaredTrailers returns the canonical names announced by the Trailer
+// header of h, rejecting those that can't be trailers.
+func declaredTrailers(h *headers.Headers) (map[string]bool, error) {
+	var declared map[string]bool
+	for _, value := range h.Values("Trailer") {
+		for _, name := range strings.Split(value, ",") {
+			name = headers.CanonicalKey(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+			if prohibitedTrailers[name] {
+				return nil, fmt.Errorf("%w: %s", ErrProhibitedTrailer, name)
+			}
+			if declared == nil {
+				declared = make(map[string]bool)
+			}
+			declared[name] = true
+		}
+	}
+	return declared, nil
+}
+
+// checkTrailers makes sure every field of trailers was announced and may be
+// sent after the body.
+func (w *Writer) checkTrailers(trailers *headers.Headers) error {
+	for name := range trailers.All() {
+		if prohibitedTrailers[name] {
+			return fmt.Errorf("%w: %s", ErrProhibitedTrailer, name)
+		}
+		if !w.trailers[name] {
+			return fmt.Errorf("%w: %s", ErrUndeclaredTrailer, name)
+		}
+	}
+	return nil
+}
+
+// EndChunkedBody ends a chunked body: it writes the last chunk, the trailer
+// fields, and the empty line completing the response. trailers may be nil.
+// The trailers are checked against the response's Trailer header before
+// anything is written. A body held back for lack of a declared length is
+// sent chunked so it can carry them. A response whose status code allows no
+// body is complete with its headers, so EndChunkedBody does nothing.
+func (w *Writer) EndChunkedBody(trailers *headers.Headers) error {
+	if w.state != writerStateHeadersWritten {
+		return errors.New("EndChunkedBody must be called after WriteHeaders")
+	}
+	if !bodyAllowed(w.statusCode) {
+		return nil
+	}
+	if trailers == nil {
+		trailers = headers.NewHeaders()
+	}
+	if err := w.checkTrailers(trailers); err != nil {
+		return err
+	}
+	if err := trailers.Validate(); err != nil {
+		return err
+	}
+
+	if w.pending != nil {
+		if err := w.startChunked(); err != nil {
+			return err
+		}
+	}
+	if !w.chunked {
+		return errors.New("EndChunkedBody called on a body that isn't chunked")
+	}
+	if _, err := w.WriteChunkedBodyDone(); err != nil {
+		return err
+	}
+	return w.WriteTrailers(trailers)
+}
@@ -0,0 +1,310 @@
+package router
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+)
+
+// MountPathKey is the path parameter holding the part of the path below the
+// prefix of a mounted handler.
+const MountPathKey = "*"
+
+type segmentKind int
+
+// The order of the kinds is their precedence: when several routes match a
+// path, the one with a literal segment wins over a parameter, which wins
+// over a wildcard.
+const (
+	segmentLiteral segmentKind = iota
+	segmentParam
+	segmentWildcard
+)
+
+type segment struct {
+	kind segmentKind
+	// value is the literal text, or the parameter name
+	value string
+}
+
+type route struct {
+	// method is empty for routes matching any method
+	method   string
+	segments []segment
+	handler  server.Handler
+}
+
+// MethodNotAllowedHandler responds to a request whose path matches a route
+// but whose method doesn't. allowed lists the methods the path supports.
+type MethodNotAllowedHandler func(w *response.Writer, req *request.Request, allowed []string)
+
+type table struct {
+	routes           []*route
+	notFound         server.Handler
+	methodNotAllowed MethodNotAllowedHandler
+}
+
+// Router dispatches requests to handlers by method and path pattern. A
+// pattern is a path whose segments are either literal text, a parameter
+// such as "{id}" matching one segment, or, as the last segment, a wildcard
+// such as "{path...}" matching the rest of the path. Parameters are read
+// with Request.PathValue.
+//
+// Requests matching no pattern get a 404, and requests whose path matches
+// but whose method doesn't get a 405 with an Allow header.
+type Router struct {
+	table  *table
+	prefix string
+}
+
+func New() *Router {
+	return &Router{
+		table: &table{
+			notFound:         defaultNotFound,
+			methodNotAllowed: defaultMethodNotAllowed,
+		},
+	}
+}
+
+// Handle registers handler for requests with the given method whose path
+// matches pattern. An empty method matches any method. It panics if the
+// pattern is malformed.
+func (r *Router) Handle(method, pattern string, handler server.Handler) {
+	segments, err := parsePattern(r.prefix + pattern)
+	if err != nil {
+		panic(err)
+	}
+	r.table.routes = append(r.table.routes, &route{
+		method:   method,
+		segments: segments,
+		handler:  handler,
+	})
+}
+
+func (r *Router) Get(pattern string, handler server.Handler) {
+	r.Handle("GET", pattern, handler)
+}
+
+func (r *Router) Post(pattern string, handler server.Handler) {
+	r.Handle("POST", pattern, handler)
+}
+
+func (r *Router) Put(pattern string, handler server.Handler) {
+	r.Handle("PUT", pattern, handler)
+}
+
+func (r *Router) Patch(pattern string, handler server.Handler) {
+	r.Handle("PATCH", pattern, handler)
+}
+
+func (r *Router) Delete(pattern string, handler server.Handler) {
+	r.Handle("DELETE", pattern, handler)
+}
+
+// Group returns a router whose patterns are prefixed with prefix. Routes
+// registered on it are served by r.
+func (r *Router) Group(prefix string) *Router {
+	return &Router{
+		table:  r.table,
+		prefix: r.prefix + strings.TrimSuffix(prefix, "/"),
+	}
+}
+
+// Mount passes every request for prefix or a path below it to handler,
+// whatever the method. The rest of the path, starting with a slash, is
+// available as the MountPathKey path parameter. A mounted Router matches its
+// patterns against that rest of the path.
+func (r *Router) Mount(prefix string, handler server.Handler) {
+	prefix = strings.TrimSuffix(prefix, "/")
+	r.Handle("", prefix+"/{"+MountPathKey+"...}", func(w *response.Writer, req *request.Request) {
+		req.SetPathValue(MountPathKey, "/"+req.PathValue(MountPathKey))
+		handler(w, req)
+	})
+	if r.prefix+prefix != "" {
+		r.Handle("", prefix, func(w *response.Writer, req *request.Request) {
+			req.SetPathValue(MountPathKey, "/")
+			handler(w, req)
+		})
+	}
+}
+
+// NotFound sets the handler for requests no route matches.
+func (r *Router) NotFound(handler server.Handler) {
+	r.table.notFound = handler
+}
+
+// MethodNotAllowed sets the handler for requests whose path matches a route
+// but whose method doesn't.
+func (r *Router) MethodNotAllowed(handler MethodNotAllowedHandler) {
+	r.table.methodNotAllowed = handler
+}
+
+// ServeRequest dispatches req to the best matching route. It has the
+// signature of a server.Handler.
+func (r *Router) ServeRequest(w *response.Writer, req *request.Request) {
+	path := req.PathValue(MountPathKey)
+	if path == "" {
+		path = req.Path()
+	}
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+
+	var best *route
+	var bestValues map[string]string
+	allowed := map[string]bool{}
+	for _, rt := range r.table.routes {
+		values, ok := rt.match(parts)
+		if !ok {
+			continue
+		}
+		if rt.method != "" && rt.method != req.RequestLine.Method {
+			allowed[rt.method] = true
+			continue
+		}
+		if best == nil || rt.moreSpecific(best) {
+			best = rt
+			bestValues = values
+		}
+	}
+
+	if best == nil {
+		if len(allowed) > 0 {
+			methods := make([]string, 0, len(allowed))
+			for method := range allowed {
+				methods = append(methods, method)
+			}
+			sort.Strings(methods)
+			r.table.methodNotAllowed(w, req, methods)
+			return
+		}
+		r.table.notFound(w, req)
+		return
+	}
+
+	for name, value := range bestValues {
+		req.SetPathValue(name, value)
+	}
+	best.handler(w, req)
+}
+
+// match reports whether the path split into parts matches the route, along
+// with the parameter values.
+func (rt *route) match(parts []string) (map[string]string, bool) {
+	var values map[string]string
+	setValue := func(name, value string) {
+		if values == nil {
+			values = map[string]string{}
+		}
+		values[name] = value
+	}
+
+	for i, seg := range rt.segments {
+		if i >= len(parts) {
+			return nil, false
+		}
+		if seg.kind == segmentWildcard {
+			rest, err := url.PathUnescape(strings.Join(parts[i:], "/"))
+			if err != nil {
+				return nil, false
+			}
+			setValue(seg.value, rest)
+			return values, true
+		}
+		switch seg.kind {
+		case segmentLiteral:
+			if parts[i] != seg.value {
+				return nil, false
+			}
+		case segmentParam:
+			if parts[i] == "" {
+				return nil, false
+			}
+			value, err := url.PathUnescape(parts[i])
+			if err != nil {
+				return nil, false
+			}
+			setValue(seg.value, value)
+		}
+	}
+	return values, len(parts) == len(rt.segments)
+}
+
+// moreSpecific reports whether rt takes precedence over other when both
+// match a path.
+func (rt *route) moreSpecific(other *route) bool {
+	for i := 0; i < len(rt.segments) && i < len(other.segments); i++ {
+		if rt.segments[i].kind != other.segments[i].kind {
+			return rt.segments[i].kind < other.segments[i].kind
+		}
+	}
+	if len(rt.segments) != len(other.segments) {
+		return len(rt.segments) > len(other.segments)
+	}
+	// a route for the exact method wins over one for any method
+	return rt.method != "" && other.method == ""
+}
+
+func parsePattern(pattern string) ([]segment, error) {
+	if !strings.HasPrefix(pattern, "/") {
+		return nil, fmt.Errorf("router: pattern must start with a slash: %q", pattern)
+	}
+
+	parts := strings.Split(pattern[1:], "/")
+	segments := make([]segment, 0, len(parts))
+	for i, part := range parts {
+		if !strings.HasPrefix(part, "{") {
+			segments = append(segments, segment{kind: segmentLiteral, value: part})
+			continue
+		}
+		if !strings.HasSuffix(part, "}") {
+			return nil, fmt.Errorf("router: unterminated parameter in pattern %q", pattern)
+		}
+		name := part[1 : len(part)-1]
+		kind := segmentParam
+		if strings.HasSuffix(name, "...") {
+			if i != len(parts)-1 {
+				return nil, fmt.Errorf("router: wildcard must be the last segment in pattern %q", pattern)
+			}
+			name = strings.TrimSuffix(name, "...")
+			kind = segmentWildcard
+		}
+		if name == "" {
+			return nil, fmt.Errorf("router: empty parameter name in pattern %q", pattern)
+		}
+		segments = append(segments, segment{kind: kind, value: name})
+	}
+	return segments, nil
+}
+
+func defaultNotFound(w *response.Writer, req *request.Request) {
+	writeError(w, response.StatusNotFound, "Not Found\n", nil)
+}
+
+func defaultMethodNotAllowed(w *response.Writer, req *request.Request, allowed []string) {
+	h := headers.NewHeaders()
+	h.Set("Allow", strings.Join(allowed, ", "))
+	writeError(w, response.StatusMethodNotAllowed, "Method Not Allowed\n", h)
+}
+
+func writeError(w *response.Writer, statusCode response.StatusCode, body string, h *headers.Headers) {
+	if h == nil {
+		h = headers.NewHeaders()
+	}
+	h.Set("Content-Type", "text/plain")
+	h.SetContentLength(int64(len(body)))
+
+	err := w.WriteStatusLine(statusCode)
+	if err != nil {
+		return
+	}
+	err = w.WriteHeaders(h)
+	if err != nil {
+		return
+	}
+	w.WriteBody([]byte(body))
+}
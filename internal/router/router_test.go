@@ -0,0 +1,143 @@
+package router
+
+import (
+	"bytes"
+	"regexp"
+	"testing"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// addedFields matches the header fields the response writer adds on its own.
+var addedFields = regexp.MustCompile(`(Date|Content-Length): [^\r]*\r\n`)
+
+// serve runs a request through the router and returns the raw response,
+// without the fields added by the writer.
+func serve(t *testing.T, r *Router, method, target string) string {
+	t.Helper()
+	req, err := request.RequestFromReader(bytes.NewBufferString(method + " " + target + " HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	w := response.NewWriter(&buf)
+	r.ServeRequest(w, req)
+	require.NoError(t, w.Finish())
+	return addedFields.ReplaceAllString(buf.String(), "")
+}
+
+// text responds with the given body followed by the path values named in
+// params.
+func text(body string, params ...string) func(w *response.Writer, req *request.Request) {
+	return func(w *response.Writer, req *request.Request) {
+		out := body
+		for _, name := range params {
+			out += " " + name + "=" + req.PathValue(name)
+		}
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(headers.NewHeaders())
+		w.WriteBody([]byte(out))
+	}
+}
+
+func TestRouting(t *testing.T) {
+	r := New()
+	r.Get("/", text("root"))
+	r.Get("/users", text("list"))
+	r.Post("/users", text("create"))
+	r.Get("/users/me", text("me"))
+	r.Get("/users/{id}", text("user", "id"))
+	r.Delete("/users/{id}", text("delete", "id"))
+	r.Get("/users/{id}/posts/{post}", text("post", "id", "post"))
+	r.Get("/static/{path...}", text("static", "path"))
+
+	// Test: Literal routes
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n\r\nroot", serve(t, r, "GET", "/"))
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n\r\nlist", serve(t, r, "GET", "/users"))
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n\r\ncreate", serve(t, r, "POST", "/users"))
+
+	// Test: Query string is ignored
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n\r\nlist", serve(t, r, "GET", "/users?page=2"))
+
+	// Test: Literal takes precedence over a parameter
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n\r\nme", serve(t, r, "GET", "/users/me"))
+
+	// Test: Parameters
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n\r\nuser id=42", serve(t, r, "GET", "/users/42"))
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n\r\nuser id=a b", serve(t, r, "GET", "/users/a%20b"))
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n\r\npost id=1 post=2", serve(t, r, "GET", "/users/1/posts/2"))
+
+	// Test: Wildcard
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n\r\nstatic path=css/site.css", serve(t, r, "GET", "/static/css/site.css"))
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n\r\nstatic path=", serve(t, r, "GET", "/static/"))
+
+	// Test: Not found
+	got := serve(t, r, "GET", "/nope")
+	assert.Contains(t, got, "HTTP/1.1 404 Not Found\r\n")
+	got = serve(t, r, "GET", "/users/1/posts")
+	assert.Contains(t, got, "HTTP/1.1 404 Not Found\r\n")
+	got = serve(t, r, "GET", "/static")
+	assert.Contains(t, got, "HTTP/1.1 404 Not Found\r\n")
+
+	// Test: Method not allowed lists the allowed methods
+	got = serve(t, r, "PUT", "/users")
+	assert.Contains(t, got, "HTTP/1.1 405 Method Not Allowed\r\n")
+	assert.Contains(t, got, "Allow: GET, POST\r\n")
+	got = serve(t, r, "PUT", "/users/7")
+	assert.Contains(t, got, "Allow: DELETE, GET\r\n")
+}
+
+func TestGroupAndMount(t *testing.T) {
+	r := New()
+	api := r.Group("/api/v1")
+	api.Get("/items/{id}", text("item", "id"))
+
+	sub := New()
+	sub.Get("/", text("sub root"))
+	sub.Get("/things/{id}", text("thing", "id"))
+	r.Mount("/sub", sub.ServeRequest)
+
+	r.Mount("/raw", text("raw", MountPathKey))
+	r.Handle("", "/any", text("any"))
+
+	// Test: Group prefix
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n\r\nitem id=9", serve(t, r, "GET", "/api/v1/items/9"))
+	assert.Contains(t, serve(t, r, "GET", "/items/9"), "404")
+
+	// Test: Mounted router matches below the prefix
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n\r\nsub root", serve(t, r, "GET", "/sub"))
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n\r\nsub root", serve(t, r, "GET", "/sub/"))
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n\r\nthing id=3", serve(t, r, "GET", "/sub/things/3"))
+	assert.Contains(t, serve(t, r, "POST", "/sub/things/3"), "HTTP/1.1 405 Method Not Allowed\r\n")
+
+	// Test: Mounted handler gets the rest of the path for any method
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n\r\nraw *=/", serve(t, r, "GET", "/raw"))
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n\r\nraw *=/a/b", serve(t, r, "POST", "/raw/a/b"))
+
+	// Test: Empty method matches any method
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n\r\nany", serve(t, r, "PATCH", "/any"))
+}
+
+func TestCustomErrorHandlers(t *testing.T) {
+	r := New()
+	r.Get("/only-get", text("ok"))
+	r.NotFound(text("custom not found"))
+	r.MethodNotAllowed(func(w *response.Writer, req *request.Request, allowed []string) {
+		text("custom not allowed")(w, req)
+		assert.Equal(t, []string{"GET"}, allowed)
+	})
+
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n\r\ncustom not found", serve(t, r, "GET", "/missing"))
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n\r\ncustom not allowed", serve(t, r, "POST", "/only-get"))
+}
+
+func TestInvalidPatterns(t *testing.T) {
+	r := New()
+	assert.Panics(t, func() { r.Get("users", text("x")) })
+	assert.Panics(t, func() { r.Get("/users/{id", text("x")) })
+	assert.Panics(t, func() { r.Get("/users/{}", text("x")) })
+	assert.Panics(t, func() { r.Get("/files/{path...}/edit", text("x")) })
+}
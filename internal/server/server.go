@@ -1,66 +1,604 @@
 package server
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"net"
+	"runtime/debug"
+	"sync"
 	"sync/atomic"
+	"syscall"
+	"time"
 
+	"httpfromtcp/internal/chunked"
+	"httpfromtcp/internal/headers"
 	"httpfromtcp/internal/request"
 	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/stream"
 )
 
+// defaultIdleTimeout bounds how long a keep-alive connection waits for the
+// client's next request when neither IdleTimeout nor ReadTimeout is set.
+const defaultIdleTimeout = 2 * time.Minute
+
+// lingerTimeout bounds how long a connection closed by the server keeps
+// draining input the client already sent.
+const lingerTimeout = 500 * time.Millisecond
+
+// maxLingerBytes bounds how much input is drained before closing.
+const maxLingerBytes = 256 << 10
+
+// writeBufferSize is the size of the buffer responses are written through,
+// so the many small writes making up a response reach the connection as a
+// few larger ones.
+const writeBufferSize = 4 << 10
+
+// readBufferSize is the size the buffer requests are read into starts at,
+// enough for the request line and headers of most requests in a single read.
+const readBufferSize = 4 << 10
+
+// maxDiscardBytes bounds how much of a streamed body left unread by the
+// handler is skipped to keep the connection open.
+const maxDiscardBytes = 256 << 10
+
+// ConnState is the state of a client connection, reported to the
+// Config.ConnState hook as the connection moves through it.
+type ConnState int
+
+const (
+	// StateNew is a connection that was just accepted and hasn't sent a
+	// byte of a request yet.
+	StateNew ConnState = iota
+	// StateActive is a connection in the middle of a request.
+	StateActive
+	// StateIdle is a keep-alive connection waiting for its next request.
+	StateIdle
+	// StateClosed is a connection that was closed.
+	StateClosed
+)
+
+func (c ConnState) String() string {
+	switch c {
+	case StateNew:
+		return "new"
+	case StateActive:
+		return "active"
+	case StateIdle:
+		return "idle"
+	case StateClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+// ErrServerClosed is returned by Serve and ListenAndServe once the server
+// has been closed or shut down.
+var ErrServerClosed = errors.New("server closed")
+
 type Handler func(w *response.Writer, req *request.Request)
 
+// Middleware wraps a Handler with behavior that runs around it.
+type Middleware func(Handler) Handler
+
+// Chain wraps handler with middlewares. The first middleware is the
+// outermost, so it sees the request first and the finished response last.
+func Chain(handler Handler, middlewares ...Middleware) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// ErrorHandler writes the response sent when a request can't be parsed. The
+// connection is closed once it returns.
+type ErrorHandler func(w *response.Writer, statusCode response.StatusCode, err error)
+
+type Config struct {
+	// Addr is the TCP address ListenAndServe listens on, in the form
+	// "host:port". ":http" is used when empty.
+	Addr string
+	// Listener, when set, is used by ListenAndServe instead of listening
+	// on Addr.
+	Listener net.Listener
+
+	// Handler is called for every request.
+	Handler Handler
+	// ErrorHandler writes the error page for malformed requests.
+	// DefaultErrorHandler is used when nil.
+	ErrorHandler ErrorHandler
+
+	// ReadHeaderTimeout bounds reading a request's line and headers.
+	// ReadTimeout is used when zero or shorter.
+	ReadHeaderTimeout time.Duration
+	// ReadTimeout bounds reading a whole request, body included. Zero
+	// means no timeout.
+	ReadTimeout time.Duration
+	// WriteTimeout bounds writing the response, counted from the end of
+	// reading the request. Zero means no timeout.
+	WriteTimeout time.Duration
+	// IdleTimeout bounds waiting for the next request on a keep-alive
+	// connection. ReadTimeout is used when zero, or two minutes if that
+	// is zero too.
+	IdleTimeout time.Duration
+
+	// MaxRequestLineLength bounds the length of a request line, longer
+	// ones get a 414. The request package default is used when zero.
+	MaxRequestLineLength int
+	// MaxHeaderBytes bounds the size of a request's header section. The
+	// request package default is used when zero.
+	MaxHeaderBytes int
+	// MaxHeaderCount bounds the number of header fields in a request.
+	// Both header limits answer with a 431. The request package default
+	// is used when zero.
+	MaxHeaderCount int
+	// MaxBodyBytes bounds the size of a request body. The request package
+	// default is used when zero.
+	MaxBodyBytes int
+	// ObsFold selects whether request header fields continued on the
+	// next line get a 400, the default, or are unfolded.
+	ObsFold headers.ObsFold
+	// StreamRequestBody makes the handler run as soon as a request's
+	// headers are read, with the body read from Request.BodyReader
+	// instead of Request.Body. Whatever the handler leaves unread is
+	// discarded before the next request, up to a limit past which the
+	// connection is closed instead.
+	StreamRequestBody bool
+	// MaxConns bounds the number of connections served at once. Further
+	// connections wait in the listener's backlog. Zero means no limit.
+	MaxConns int
+
+	// ServerHeader, when set, is sent as the Server header of responses
+	// that don't set one.
+	ServerHeader string
+
+	// ErrorLog receives errors the server can't return to a caller, such
+	// as failed accepts it retries. The log package's standard logger is
+	// used when nil.
+	ErrorLog *log.Logger
+	// ConnState, when set, is called every time a connection changes
+	// state.
+	ConnState func(conn net.Conn, state ConnState)
+}
+
 type Server struct {
+	config Config
+	closed atomic.Bool
+	// done is closed along with the server, waking up an accept loop
+	// blocked on MaxConns
+	done chan struct{}
+	// connSlots holds a token per open connection when MaxConns is set
+	connSlots chan struct{}
+
+	mu       sync.Mutex
 	listener net.Listener
-	closed   atomic.Bool
-	handler  Handler
+	conns    map[net.Conn]ConnState
+	wg       sync.WaitGroup
 }
 
+// New returns a server for config. Call ListenAndServe or Serve to start
+// accepting connections.
+func New(config Config) *Server {
+	if config.ErrorHandler == nil {
+		config.ErrorHandler = DefaultErrorHandler
+	}
+	if config.ReadHeaderTimeout == 0 || (config.ReadTimeout > 0 && config.ReadTimeout < config.ReadHeaderTimeout) {
+		config.ReadHeaderTimeout = config.ReadTimeout
+	}
+	if config.IdleTimeout == 0 {
+		config.IdleTimeout = config.ReadTimeout
+	}
+	if config.IdleTimeout == 0 {
+		config.IdleTimeout = defaultIdleTimeout
+	}
+
+	server := &Server{
+		config:   config,
+		done:     make(chan struct{}),
+		listener: config.Listener,
+		conns:    map[net.Conn]ConnState{},
+	}
+	if config.MaxConns > 0 {
+		server.connSlots = make(chan struct{}, config.MaxConns)
+	}
+	return server
+}
+
+// Serve listens on port and serves handler in the background until the
+// returned server is closed.
 func Serve(port int, handler Handler) (*Server, error) {
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
 		return nil, err
 	}
 
-	server := &Server{
-		listener: listener,
-		closed:   atomic.Bool{},
-		handler:  handler,
-	}
-
-	go server.listen()
+	server := New(Config{Listener: listener, Handler: handler})
+	go server.Serve(listener)
 
 	return server, nil
 }
 
-func (s *Server) Close() error {
-	s.closed.Store(true)
-	return s.listener.Close()
+// ListenAndServe listens on the configured Listener or Addr and serves
+// connections until the server is closed. It always returns a non-nil
+// error, ErrServerClosed after Close or Shutdown.
+func (s *Server) ListenAndServe() error {
+	s.mu.Lock()
+	listener := s.listener
+	s.mu.Unlock()
+
+	if listener == nil {
+		addr := s.config.Addr
+		if addr == "" {
+			addr = ":http"
+		}
+		var err error
+		listener, err = net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+	}
+	return s.Serve(listener)
 }
 
-func (s *Server) listen() {
+// Serve accepts connections on listener and serves each one in its own
+// goroutine. It blocks until the server is closed or Accept fails with a
+// non-temporary error, which is returned. Temporary failures, like running
+// out of file descriptors, are logged and retried after a short pause.
+func (s *Server) Serve(listener net.Listener) error {
+	s.mu.Lock()
+	if s.closed.Load() {
+		s.mu.Unlock()
+		listener.Close()
+		return ErrServerClosed
+	}
+	s.listener = listener
+	s.mu.Unlock()
+	defer listener.Close()
+
+	var retryDelay time.Duration
 	for {
-		conn, err := s.listener.Accept()
+		if s.connSlots != nil {
+			select {
+			case s.connSlots <- struct{}{}:
+			case <-s.done:
+				return ErrServerClosed
+			}
+		}
+
+		conn, err := listener.Accept()
 		if err != nil {
+			s.releaseSlot()
 			if s.closed.Load() {
-				return
+				return ErrServerClosed
+			}
+			if !isTemporary(err) {
+				return err
 			}
+			retryDelay = min(max(2*retryDelay, 5*time.Millisecond), time.Second)
+			s.logf("accept error: %v; retrying in %v", err, retryDelay)
+			time.Sleep(retryDelay)
 			continue
 		}
+		retryDelay = 0
 
+		if !s.trackConn(conn) {
+			conn.Close()
+			s.releaseSlot()
+			continue
+		}
 		go s.handle(conn)
 	}
 }
 
-func (s *Server) handle(conn net.Conn) {
-	defer conn.Close()
+// Close stops accepting connections and closes every open connection,
+// including those with requests in progress.
+func (s *Server) Close() error {
+	err := s.stopListening()
+	s.closeConns(false)
+	return err
+}
 
-	req, err := request.RequestFromReader(conn)
-	if err != nil {
+// Shutdown stops accepting connections, closes idle ones and waits for
+// requests in progress to finish, closing each connection once its response
+// is written. If ctx expires first, the remaining connections are closed and
+// ctx's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.stopListening()
+	s.closeConns(true)
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+		s.closeConns(false)
+		return ctx.Err()
+	}
+}
+
+// stopListening marks the server closed and closes its listener.
+func (s *Server) stopListening() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed.Swap(true) {
+		close(s.done)
+	}
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Close()
+}
+
+// Addr returns the address the server is listening on, or nil if it hasn't
+// started listening yet.
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// trackConn registers a new connection. It returns false if the server is
+// shutting down.
+func (s *Server) trackConn(conn net.Conn) bool {
+	s.mu.Lock()
+	if s.closed.Load() {
+		s.mu.Unlock()
+		return false
+	}
+	s.conns[conn] = StateNew
+	s.wg.Add(1)
+	s.mu.Unlock()
+
+	s.notifyConnState(conn, StateNew)
+	return true
+}
+
+func (s *Server) untrackConn(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+
+	s.notifyConnState(conn, StateClosed)
+	s.releaseSlot()
+	s.wg.Done()
+}
+
+// setConnState records the state of a tracked connection. It returns false
+// when a connection goes idle while the server is shutting down, in which
+// case the caller should close it instead of waiting for another request.
+func (s *Server) setConnState(conn net.Conn, state ConnState) bool {
+	s.mu.Lock()
+	if state == StateIdle && s.closed.Load() {
+		s.mu.Unlock()
+		return false
+	}
+	changed := s.conns[conn] != state
+	s.conns[conn] = state
+	s.mu.Unlock()
+
+	if changed {
+		s.notifyConnState(conn, state)
+	}
+	return true
+}
+
+func (s *Server) notifyConnState(conn net.Conn, state ConnState) {
+	if s.config.ConnState != nil {
+		s.config.ConnState(conn, state)
+	}
+}
+
+// closeConns closes tracked connections, only those waiting for a request if
+// idleOnly is set. Their goroutines notice on the next read or write and
+// clean up.
+func (s *Server) closeConns(idleOnly bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn, state := range s.conns {
+		if idleOnly && state == StateActive {
+			continue
+		}
+		conn.Close()
+	}
+}
+
+func (s *Server) releaseSlot() {
+	if s.connSlots != nil {
+		<-s.connSlots
+	}
+}
+
+func (s *Server) logf(format string, args ...any) {
+	if s.config.ErrorLog != nil {
+		s.config.ErrorLog.Printf(format, args...)
 		return
 	}
+	log.Printf(format, args...)
+}
+
+// handle serves requests from conn one at a time. Pipelined requests wait in
+// the reader's buffer until the previous response has been written, so
+// responses always go out in request order.
+func (s *Server) handle(conn net.Conn) {
+	defer s.untrackConn(conn)
+	defer closeConn(conn)
+
+	// start is when reading the current request began, the read timeouts
+	// count from there
+	start := time.Now()
+
+	reader := request.NewReaderWithOptions(conn, request.ParseOptions{
+		MaxRequestLineLength: s.config.MaxRequestLineLength,
+		MaxHeaderBytes:       s.config.MaxHeaderBytes,
+		MaxHeaderCount:       s.config.MaxHeaderCount,
+		MaxBodyBytes:         s.config.MaxBodyBytes,
+		ObsFold:              s.config.ObsFold,
+		StreamBody:           s.config.StreamRequestBody,
+		BufferSize:           readBufferSize,
+	})
+	reader.OnHeaders(func() {
+		conn.SetReadDeadline(stream.Deadline(start, s.config.ReadTimeout))
+	})
+	out := bufio.NewWriterSize(conn, writeBufferSize)
+	for first := true; ; first = false {
+		// the connection counts as active from the first byte of a
+		// request, so Shutdown lets a request that is still arriving
+		// finish
+		if first {
+			conn.SetReadDeadline(stream.Deadline(start, s.config.ReadHeaderTimeout))
+		} else {
+			if !s.setConnState(conn, StateIdle) {
+				return
+			}
+			conn.SetReadDeadline(stream.Deadline(time.Now(), s.config.IdleTimeout))
+		}
+		if err := reader.Wait(); err != nil {
+			return
+		}
+		if !first {
+			start = time.Now()
+		}
+		s.setConnState(conn, StateActive)
+
+		conn.SetReadDeadline(stream.Deadline(start, s.config.ReadHeaderTimeout))
+		req, err := reader.ReadRequest()
+		if err != nil {
+			if statusCode, ok := errorStatus(err); ok {
+				conn.SetWriteDeadline(stream.Deadline(time.Now(), s.config.WriteTimeout))
+				writer := s.newWriter(out, "")
+				s.config.ErrorHandler(writer, statusCode, err)
+				writer.Finish()
+			}
+			return
+		}
+		if !s.config.StreamRequestBody {
+			// a streamed body is still read under ReadTimeout
+			conn.SetReadDeadline(time.Time{})
+		}
+		conn.SetWriteDeadline(stream.Deadline(time.Now(), s.config.WriteTimeout))
+
+		writer := s.newWriter(out, req.RequestLine.Method)
+		ok := s.serveRequest(writer, req)
+		if !ok {
+			// the response is cut short, but what the handler wrote
+			// still goes out before the connection closes
+			out.Flush()
+			return
+		}
+		if writer.Finish() != nil {
+			return
+		}
+
+		conn.SetWriteDeadline(time.Time{})
+		if !req.KeepAlive() || !writer.KeepAlive() {
+			return
+		}
+		if err := reader.DiscardBody(maxDiscardBytes); err != nil {
+			return
+		}
+	}
+}
+
+// newWriter returns the writer for a response to a request with method, which
+// is empty when the request couldn't be parsed.
+func (s *Server) newWriter(out io.Writer, method string) *response.Writer {
+	options := []response.Option{response.WithMethod(method)}
+	if s.config.ServerHeader != "" {
+		options = append(options, response.WithServer(s.config.ServerHeader))
+	}
+	return response.NewWriter(out, options...)
+}
+
+// serveRequest runs the handler. A panic is logged and reported by returning
+// false, the connection can't be trusted to carry another response after it.
+func (s *Server) serveRequest(w *response.Writer, req *request.Request) (ok bool) {
+	defer func() {
+		if err := recover(); err != nil {
+			s.logf("panic serving %s %s: %v\n%s", req.RequestLine.Method, req.RequestLine.RequestTarget, err, debug.Stack())
+			ok = false
+		}
+	}()
+	s.config.Handler(w, req)
+	return true
+}
+
+// DefaultErrorHandler responds with the status code and the parse error as a
+// plain text body.
+func DefaultErrorHandler(w *response.Writer, statusCode response.StatusCode, err error) {
+	body := err.Error() + "\n"
 
-	writer := response.NewWriter(conn)
-	s.handler(writer, req)
+	w.WriteStatusLine(statusCode)
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "text/plain")
+	h.SetContentLength(int64(len(body)))
+	h.Set("Connection", "close")
+	w.WriteHeaders(h)
+	w.WriteBody([]byte(body))
+}
+
+// errorStatus maps a parse error to the status code reported to the client.
+// It returns false for errors that don't warrant a response, such as the
+// connection failing or the client going away mid-request.
+func errorStatus(err error) (response.StatusCode, bool) {
+	var netErr net.Error
+	switch {
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return response.StatusRequestTimeout, true
+	case errors.Is(err, request.ErrRequestLineTooLong):
+		return response.StatusURITooLong, true
+	case errors.Is(err, request.ErrHeadersTooLarge):
+		return response.StatusRequestHeaderFieldsTooLarge, true
+	case errors.Is(err, request.ErrBodyTooLarge):
+		return response.StatusContentTooLarge, true
+	case errors.Is(err, request.ErrUnsupportedVersion):
+		return response.StatusHTTPVersionNotSupported, true
+	case errors.Is(err, request.ErrUnsupportedTransferEncoding):
+		return response.StatusNotImplemented, true
+	case errors.Is(err, request.ErrMalformedRequestLine),
+		errors.Is(err, request.ErrInvalidMethod),
+		errors.Is(err, request.ErrInvalidContentLength),
+		errors.Is(err, request.ErrInvalidTransferEncoding),
+		errors.Is(err, request.ErrConflictingFraming),
+		errors.Is(err, headers.ErrMalformedHeader),
+		errors.Is(err, headers.ErrInvalidHeaderName),
+		errors.Is(err, headers.ErrInvalidHeaderValue),
+		errors.Is(err, chunked.ErrMalformedChunk),
+		errors.Is(err, chunked.ErrLineTooLong),
+		errors.Is(err, chunked.ErrTrailerTooLong):
+		return response.StatusBadRequest, true
+	default:
+		return 0, false
+	}
+}
+
+// isTemporary reports whether an Accept error is worth retrying.
+func isTemporary(err error) bool {
+	return errors.Is(err, syscall.EMFILE) ||
+		errors.Is(err, syscall.ENFILE) ||
+		errors.Is(err, syscall.ECONNABORTED) ||
+		errors.Is(err, syscall.ECONNRESET)
+}
+
+// closeConn closes the write side of conn first and discards whatever the
+// client still sends for a short while. Closing a socket with unread input,
+// such as pipelined requests we won't serve, makes the kernel reset the
+// connection, and the client may lose responses it hasn't read yet.
+func closeConn(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok && cw.CloseWrite() == nil {
+		conn.SetReadDeadline(time.Now().Add(lingerTimeout))
+		io.CopyN(io.Discard, conn, maxLingerBytes)
+	}
+	conn.Close()
 }
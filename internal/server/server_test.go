@@ -0,0 +1,685 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// echoTargetHandler responds with the request target as the body.
+func echoTargetHandler(w *response.Writer, req *request.Request) {
+	body := req.RequestLine.RequestTarget + ":" + string(req.Body)
+	w.WriteStatusLine(response.StatusOK)
+	h := headers.NewHeaders()
+	h.Set("Content-Length", fmt.Sprintf("%d", len(body)))
+	w.WriteHeaders(h)
+	w.WriteBody([]byte(body))
+}
+
+func startServer(t *testing.T, handler Handler) *Server {
+	t.Helper()
+	s, err := Serve(0, handler)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func startServerWithConfig(t *testing.T, handler Handler, config Config) *Server {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	config.Listener = listener
+	config.Handler = handler
+	s := New(config)
+	go s.ListenAndServe()
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func dial(t *testing.T, s *Server) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+// testDate stands for the Date header of responses, see normalizeDates.
+const testDate = "Date: " + headers.TimeFormat + "\r\n"
+
+var dateField = regexp.MustCompile(`Date: [^\r]*\r\n`)
+
+// normalizeDates replaces the value of the Date headers in a raw response
+// with testDate, which has the same length.
+func normalizeDates(raw []byte) string {
+	return dateField.ReplaceAllString(string(raw), testDate)
+}
+
+func okResponse(body string) string {
+	return fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Length: %d\r\n%s\r\n%s", len(body), testDate, body)
+}
+
+func TestPipelining(t *testing.T) {
+	s := startServer(t, echoTargetHandler)
+
+	// Test: Several requests in a single write are answered in order
+	conn := dial(t, s)
+	_, err := conn.Write([]byte("GET /one HTTP/1.1\r\nHost: localhost\r\n\r\n" +
+		"POST /two HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nhello" +
+		"GET /three HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+	require.NoError(t, err)
+	got, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, okResponse("/one:")+okResponse("/two:hello")+okResponse("/three:"), normalizeDates(got))
+
+	// Test: Chunked request bodies
+	conn = dial(t, s)
+	_, err = conn.Write([]byte("POST /one HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\n" +
+		"POST /two HTTP/1.1\r\nTransfer-Encoding: chunked\r\nConnection: close\r\n\r\n2\r\nde\r\n0\r\nX-Trailer: yes\r\n\r\n"))
+	require.NoError(t, err)
+	got, err = io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, okResponse("/one:abc")+okResponse("/two:de"), normalizeDates(got))
+
+	// Test: A response to HEAD has no body, so the next one follows its headers
+	conn = dial(t, s)
+	_, err = conn.Write([]byte("HEAD /one HTTP/1.1\r\n\r\n" +
+		"GET /two HTTP/1.1\r\nConnection: close\r\n\r\n"))
+	require.NoError(t, err)
+	got, err = io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, strings.TrimSuffix(okResponse("/one:"), "/one:")+okResponse("/two:"), normalizeDates(got))
+
+	// Test: Requests after "Connection: close" are not served
+	conn = dial(t, s)
+	_, err = conn.Write([]byte("GET /one HTTP/1.1\r\nConnection: close\r\n\r\n" +
+		"GET /two HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	got, err = io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, okResponse("/one:"), normalizeDates(got))
+
+	// Test: A request split across writes after a pipelined one
+	conn = dial(t, s)
+	_, err = conn.Write([]byte("GET /one HTTP/1.1\r\n\r\nGET /tw"))
+	require.NoError(t, err)
+	buf := make([]byte, len(okResponse("/one:")))
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, okResponse("/one:"), normalizeDates(buf))
+	_, err = conn.Write([]byte("o HTTP/1.1\r\nConnection: close\r\n\r\n"))
+	require.NoError(t, err)
+	got, err = io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, okResponse("/two:"), normalizeDates(got))
+}
+
+func TestKeepAlive(t *testing.T) {
+	s := startServer(t, echoTargetHandler)
+
+	// Test: Sequential requests reuse the connection
+	conn := dial(t, s)
+	for _, target := range []string{"/a", "/b", "/c"} {
+		_, err := conn.Write([]byte("GET " + target + " HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		require.NoError(t, err)
+		want := okResponse(target + ":")
+		buf := make([]byte, len(want))
+		_, err = io.ReadFull(conn, buf)
+		require.NoError(t, err)
+		assert.Equal(t, want, normalizeDates(buf))
+	}
+
+	// Test: Response asking to close ends the connection
+	s = startServer(t, func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusOK)
+		h := headers.NewHeaders()
+		h.Set("Connection", "close")
+		w.WriteHeaders(h)
+	})
+	conn = dial(t, s)
+	_, err := conn.Write([]byte("GET / HTTP/1.1\r\n\r\nGET / HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	got, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nConnection: close\r\n"+testDate+"Content-Length: 0\r\n\r\n", normalizeDates(got))
+
+	// Test: Body shorter than its Content-Length ends the connection
+	s = startServer(t, func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusOK)
+		h := headers.NewHeaders()
+		h.SetContentLength(10)
+		w.WriteHeaders(h)
+		io.WriteString(w, "short")
+	})
+	conn = dial(t, s)
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\n\r\nGET / HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	got, err = io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n"+testDate+"\r\nshort", normalizeDates(got))
+}
+
+func TestHeaderCasing(t *testing.T) {
+	s := startServer(t, func(w *response.Writer, req *request.Request) {
+		body := req.Headers.Get("x-client-NAME")
+		w.WriteStatusLine(response.StatusOK)
+		h := headers.NewHeaders()
+		h.Set("content-type", "text/plain")
+		h.Set("CONTENT-LENGTH", fmt.Sprintf("%d", len(body)))
+		h.Set("Content-Length", fmt.Sprintf("%d", len(body)))
+		w.WriteHeaders(h)
+		w.WriteBody([]byte(body))
+	})
+
+	// Test: Mixed-case names are matched and written canonically
+	conn := dial(t, s)
+	_, err := conn.Write([]byte("GET / HTTP/1.1\r\nX-CLIENT-name: curl\r\nConnection: close\r\n\r\n"))
+	require.NoError(t, err)
+	got, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 4\r\n"+testDate+"\r\ncurl", normalizeDates(got))
+}
+
+func TestHeaderValidation(t *testing.T) {
+	// Test: Folded lines unfolded when configured
+	s := startServerWithConfig(t, func(w *response.Writer, req *request.Request) {
+		req.Body = []byte(req.Headers.Get("X-Folded"))
+		echoTargetHandler(w, req)
+	}, Config{ObsFold: headers.ObsFoldReplace})
+	conn := dial(t, s)
+	_, err := conn.Write([]byte("GET / HTTP/1.1\r\nX-Folded: a\r\n \tb\r\nConnection: close\r\n\r\n"))
+	require.NoError(t, err)
+	got, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, okResponse("/:a b"), normalizeDates(got))
+
+	// Test: Handler values can't inject fields
+	writeErr := make(chan error, 1)
+	s = startServer(t, func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusOK)
+		h := headers.NewHeaders()
+		h.Set("Location", "/next\r\nSet-Cookie: session=stolen")
+		writeErr <- w.WriteHeaders(h)
+	})
+	conn = dial(t, s)
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	got, err = io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", normalizeDates(got))
+	assert.ErrorIs(t, <-writeErr, headers.ErrInvalidHeaderValue)
+}
+
+func TestErrorResponses(t *testing.T) {
+	s := startServer(t, echoTargetHandler)
+
+	tests := []struct {
+		name       string
+		request    string
+		statusLine string
+	}{
+		{"malformed request line", "GET /\r\n\r\n", "HTTP/1.1 400 Bad Request\r\n"},
+		{"invalid header name", "GET / HTTP/1.1\r\nHo st: x\r\n\r\n", "HTTP/1.1 400 Bad Request\r\n"},
+		{"control character in header value", "GET / HTTP/1.1\r\nHost: a\x00b\r\n\r\n", "HTTP/1.1 400 Bad Request\r\n"},
+		{"obsolete line folding", "GET / HTTP/1.1\r\nX-Folded: a\r\n b\r\n\r\n", "HTTP/1.1 400 Bad Request\r\n"},
+		{"whitespace before the first field", "POST / HTTP/1.1\r\n Transfer-Encoding: chunked\r\n\r\n0\r\n\r\n", "HTTP/1.1 400 Bad Request\r\n"},
+		{"whitespace before the colon", "POST / HTTP/1.1\r\nContent-Length\t: 3\r\n\r\nabc", "HTTP/1.1 400 Bad Request\r\n"},
+		{"bad content length", "POST / HTTP/1.1\r\nContent-Length: abc\r\n\r\n", "HTTP/1.1 400 Bad Request\r\n"},
+		{"unsupported version", "GET / HTTP/1.0\r\n\r\n", "HTTP/1.1 505 HTTP Version Not Supported\r\n"},
+		{"body too large", "POST / HTTP/1.1\r\nContent-Length: 99999999999\r\n\r\n", "HTTP/1.1 413 Content Too Large\r\n"},
+		{"content length with transfer encoding", "POST / HTTP/1.1\r\nContent-Length: 1\r\nTransfer-Encoding: chunked\r\n\r\n", "HTTP/1.1 400 Bad Request\r\n"},
+		{"unsupported transfer coding", "POST / HTTP/1.1\r\nTransfer-Encoding: gzip, chunked\r\n\r\n", "HTTP/1.1 501 Not Implemented\r\n"},
+		{"malformed chunk", "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\nxyz\r\n", "HTTP/1.1 400 Bad Request\r\n"},
+		{"request line too long", "GET /" + strings.Repeat("a", 10000) + " HTTP/1.1\r\n\r\n", "HTTP/1.1 414 URI Too Long\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := dial(t, s)
+			_, err := conn.Write([]byte(tt.request))
+			require.NoError(t, err)
+			got, err := io.ReadAll(conn)
+			require.NoError(t, err)
+			assert.True(t, strings.HasPrefix(normalizeDates(got), tt.statusLine), "got %q", got)
+			assert.Contains(t, normalizeDates(got), "Connection: close\r\n")
+		})
+	}
+
+	// Test: Valid responses written before a malformed pipelined request
+	conn := dial(t, s)
+	_, err := conn.Write([]byte("GET /one HTTP/1.1\r\n\r\nBROKEN\r\n\r\n"))
+	require.NoError(t, err)
+	got, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(normalizeDates(got), okResponse("/one:")+"HTTP/1.1 400 Bad Request\r\n"), "got %q", got)
+}
+
+func TestCustomErrorHandler(t *testing.T) {
+	gotErr := make(chan error, 1)
+	s := startServerWithConfig(t, echoTargetHandler, Config{
+		ErrorHandler: func(w *response.Writer, statusCode response.StatusCode, err error) {
+			gotErr <- err
+			w.WriteStatusLine(statusCode)
+			h := headers.NewHeaders()
+			h.Set("Connection", "close")
+			w.WriteHeaders(h)
+			w.WriteBody([]byte("custom"))
+		},
+	})
+
+	conn := dial(t, s)
+	_, err := conn.Write([]byte("GET / HTTP/1.1\r\nHost localhost\r\n\r\n"))
+	require.NoError(t, err)
+	got, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 400 Bad Request\r\nConnection: close\r\n"+testDate+"Content-Length: 6\r\n\r\ncustom", normalizeDates(got))
+	assert.True(t, errors.Is(<-gotErr, headers.ErrMalformedHeader))
+}
+
+func TestShutdown(t *testing.T) {
+	// Test: Idle keep-alive connections are closed
+	s := startServer(t, echoTargetHandler)
+	conn := dial(t, s)
+	_, err := conn.Write([]byte("GET /one HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	buf := make([]byte, len(okResponse("/one:")))
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	require.NoError(t, s.Shutdown(context.Background()))
+	got, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Empty(t, got)
+
+	// Test: In-flight requests finish before Shutdown returns
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	s = startServer(t, func(w *response.Writer, req *request.Request) {
+		close(entered)
+		<-release
+		echoTargetHandler(w, req)
+	})
+	conn = dial(t, s)
+	_, err = conn.Write([]byte("GET /slow HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	<-entered
+
+	shutdownErr := make(chan error, 1)
+	go func() { shutdownErr <- s.Shutdown(context.Background()) }()
+	select {
+	case err := <-shutdownErr:
+		t.Fatalf("Shutdown returned before the request finished: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	_, err = net.Dial("tcp", s.Addr().String())
+	assert.Error(t, err)
+
+	close(release)
+	got, err = io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, okResponse("/slow:"), normalizeDates(got))
+	assert.NoError(t, <-shutdownErr)
+
+	// Test: A first request still arriving is read and served
+	s = startServer(t, echoTargetHandler)
+	conn = dial(t, s)
+	_, err = conn.Write([]byte("POST /upload HTTP/1.1\r\nContent-Length: 5\r\n\r\nhe"))
+	require.NoError(t, err)
+	time.Sleep(20 * time.Millisecond)
+	go func() { shutdownErr <- s.Shutdown(context.Background()) }()
+	time.Sleep(20 * time.Millisecond)
+	_, err = conn.Write([]byte("llo"))
+	require.NoError(t, err)
+	got, err = io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, okResponse("/upload:hello"), normalizeDates(got))
+	assert.NoError(t, <-shutdownErr)
+
+	// Test: Remaining connections are closed when the context expires
+	entered = make(chan struct{})
+	release = make(chan struct{})
+	defer close(release)
+	s = startServer(t, func(w *response.Writer, req *request.Request) {
+		close(entered)
+		<-release
+	})
+	conn = dial(t, s)
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	<-entered
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, s.Shutdown(ctx), context.DeadlineExceeded)
+	got, err = io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Empty(t, got)
+}
+
+// servePipe serves one end of an in-memory connection and returns the other
+// end to act as the client.
+func servePipe(t *testing.T, s *Server) net.Conn {
+	t.Helper()
+	serverConn, clientConn := net.Pipe()
+	require.True(t, s.trackConn(serverConn))
+	go s.handle(serverConn)
+	t.Cleanup(func() { clientConn.Close() })
+	return clientConn
+}
+
+// slowWrite writes data one byte at a time, pausing between bytes. It stops
+// at the first error, which is expected once the server gives up.
+func slowWrite(conn net.Conn, data string, pause time.Duration) {
+	for i := range len(data) {
+		if _, err := conn.Write([]byte{data[i]}); err != nil {
+			return
+		}
+		time.Sleep(pause)
+	}
+}
+
+func TestTimeouts(t *testing.T) {
+	// Test: Headers dribbled past ReadHeaderTimeout
+	s := startServerWithConfig(t, echoTargetHandler, Config{ReadHeaderTimeout: 100 * time.Millisecond})
+	conn := servePipe(t, s)
+	go slowWrite(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n", 20*time.Millisecond)
+	got, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(normalizeDates(got), "HTTP/1.1 408 Request Timeout\r\n"), "got %q", got)
+
+	// Test: Body dribbled past ReadTimeout
+	s = startServerWithConfig(t, echoTargetHandler, Config{ReadTimeout: 100 * time.Millisecond})
+	conn = servePipe(t, s)
+	go func() {
+		conn.Write([]byte("POST / HTTP/1.1\r\nContent-Length: 20\r\n\r\n"))
+		slowWrite(conn, strings.Repeat("a", 20), 20*time.Millisecond)
+	}()
+	got, err = io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(normalizeDates(got), "HTTP/1.1 408 Request Timeout\r\n"), "got %q", got)
+
+	// Test: Slow but timely requests are served
+	s = startServerWithConfig(t, echoTargetHandler, Config{ReadHeaderTimeout: time.Second})
+	conn = servePipe(t, s)
+	go slowWrite(conn, "GET /slow HTTP/1.1\r\nConnection: close\r\n\r\n", time.Millisecond)
+	got, err = io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, okResponse("/slow:"), normalizeDates(got))
+
+	// Test: Idle keep-alive connection is closed without a response
+	s = startServerWithConfig(t, echoTargetHandler, Config{IdleTimeout: 50 * time.Millisecond})
+	conn = servePipe(t, s)
+	go conn.Write([]byte("GET /one HTTP/1.1\r\n\r\n"))
+	got, err = io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, okResponse("/one:"), normalizeDates(got))
+
+	// Test: Client not reading the response past WriteTimeout
+	writeErr := make(chan error, 1)
+	s = startServerWithConfig(t, func(w *response.Writer, req *request.Request) {
+		// the pipe is unbuffered, so flushing blocks until the client reads
+		w.WriteStatusLine(response.StatusOK)
+		writeErr <- w.Flush()
+	}, Config{WriteTimeout: 50 * time.Millisecond})
+	conn = servePipe(t, s)
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	select {
+	case err := <-writeErr:
+		var netErr net.Error
+		require.ErrorAs(t, err, &netErr)
+		assert.True(t, netErr.Timeout())
+	case <-time.After(time.Second):
+		t.Fatal("handler write did not time out")
+	}
+}
+
+func TestListenAndServe(t *testing.T) {
+	// Test: Returns ErrServerClosed once closed
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := New(Config{Listener: listener, Handler: echoTargetHandler})
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- s.ListenAndServe() }()
+
+	conn := dial(t, s)
+	_, err = conn.Write([]byte("GET /one HTTP/1.1\r\nConnection: close\r\n\r\n"))
+	require.NoError(t, err)
+	got, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, okResponse("/one:"), normalizeDates(got))
+
+	require.NoError(t, s.Close())
+	assert.ErrorIs(t, <-serveErr, ErrServerClosed)
+
+	// Test: Listen errors are returned
+	s = New(Config{Addr: "127.0.0.1:-1", Handler: echoTargetHandler})
+	assert.Error(t, s.ListenAndServe())
+
+	// Test: Serving after Close fails right away
+	s = New(Config{Handler: echoTargetHandler})
+	require.NoError(t, s.Close())
+	listener, err = net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	assert.ErrorIs(t, s.Serve(listener), ErrServerClosed)
+}
+
+func TestConfigLimits(t *testing.T) {
+	// Test: MaxHeaderBytes
+	s := startServerWithConfig(t, echoTargetHandler, Config{MaxHeaderBytes: 64})
+	conn := dial(t, s)
+	_, err := conn.Write([]byte("GET / HTTP/1.1\r\nX-Filler: " + strings.Repeat("a", 64) + "\r\n\r\n"))
+	require.NoError(t, err)
+	got, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(normalizeDates(got), "HTTP/1.1 431 Request Header Fields Too Large\r\n"), "got %q", got)
+
+	// Test: MaxRequestLineLength
+	s = startServerWithConfig(t, echoTargetHandler, Config{MaxRequestLineLength: 16})
+	conn = dial(t, s)
+	_, err = conn.Write([]byte("GET /" + strings.Repeat("a", 16) + " HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	got, err = io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(normalizeDates(got), "HTTP/1.1 414 URI Too Long\r\n"), "got %q", got)
+
+	// Test: MaxHeaderCount
+	s = startServerWithConfig(t, echoTargetHandler, Config{MaxHeaderCount: 2})
+	conn = dial(t, s)
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nA: 1\r\nB: 2\r\nC: 3\r\n\r\n"))
+	require.NoError(t, err)
+	got, err = io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(normalizeDates(got), "HTTP/1.1 431 Request Header Fields Too Large\r\n"), "got %q", got)
+
+	// Test: MaxBodyBytes
+	s = startServerWithConfig(t, echoTargetHandler, Config{MaxBodyBytes: 4})
+	conn = dial(t, s)
+	_, err = conn.Write([]byte("POST / HTTP/1.1\r\nContent-Length: 5\r\n\r\nhello"))
+	require.NoError(t, err)
+	got, err = io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(normalizeDates(got), "HTTP/1.1 413 Content Too Large\r\n"), "got %q", got)
+
+	// Test: MaxConns holds back connections beyond the limit
+	s = startServerWithConfig(t, echoTargetHandler, Config{MaxConns: 1})
+	first := dial(t, s)
+	_, err = first.Write([]byte("GET /first HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	buf := make([]byte, len(okResponse("/first:")))
+	_, err = io.ReadFull(first, buf)
+	require.NoError(t, err)
+
+	second := dial(t, s)
+	_, err = second.Write([]byte("GET /second HTTP/1.1\r\nConnection: close\r\n\r\n"))
+	require.NoError(t, err)
+	second.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = second.Read(make([]byte, 1))
+	var netErr net.Error
+	require.ErrorAs(t, err, &netErr)
+	assert.True(t, netErr.Timeout())
+
+	first.Close()
+	second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err = io.ReadAll(second)
+	require.NoError(t, err)
+	assert.Equal(t, okResponse("/second:"), normalizeDates(got))
+}
+
+func TestStreamRequestBody(t *testing.T) {
+	// streamHandler echoes the first n bytes of the body, leaving the rest
+	// unread
+	streamHandler := func(n int64) Handler {
+		return func(w *response.Writer, req *request.Request) {
+			body, err := io.ReadAll(io.LimitReader(req.BodyReader, n))
+			if err != nil {
+				body = []byte(err.Error())
+			}
+			req.Body = body
+			echoTargetHandler(w, req)
+		}
+	}
+
+	// Test: Handler reads the body as it arrives
+	s := startServerWithConfig(t, streamHandler(1<<20), Config{StreamRequestBody: true})
+	conn := dial(t, s)
+	_, err := conn.Write([]byte("POST /upload HTTP/1.1\r\nContent-Length: 11\r\n\r\nhello"))
+	require.NoError(t, err)
+	time.Sleep(20 * time.Millisecond)
+	_, err = conn.Write([]byte(" world"))
+	require.NoError(t, err)
+	want := okResponse("/upload:hello world")
+	buf := make([]byte, len(want))
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, want, normalizeDates(buf))
+
+	// Test: Unread bodies are discarded before the next request
+	s = startServerWithConfig(t, streamHandler(2), Config{StreamRequestBody: true})
+	conn = dial(t, s)
+	_, err = conn.Write([]byte("POST /one HTTP/1.1\r\nContent-Length: 5\r\n\r\nhello" +
+		"POST /two HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n3\r\ndef\r\n0\r\n\r\n" +
+		"GET /three HTTP/1.1\r\nConnection: close\r\n\r\n"))
+	require.NoError(t, err)
+	got, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, okResponse("/one:he")+okResponse("/two:ab")+okResponse("/three:"), normalizeDates(got))
+
+	// Test: Too much unread body closes the connection
+	conn = dial(t, s)
+	_, err = conn.Write([]byte(fmt.Sprintf("POST /big HTTP/1.1\r\nContent-Length: %d\r\n\r\n", maxDiscardBytes+64<<10)))
+	require.NoError(t, err)
+	go conn.Write([]byte(strings.Repeat("a", maxDiscardBytes+64<<10) + "GET /next HTTP/1.1\r\n\r\n"))
+	got, err = io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, okResponse("/big:aa"), normalizeDates(got))
+}
+
+func TestFlush(t *testing.T) {
+	// Test: Flushed output reaches the client while the handler runs
+	resume := make(chan struct{})
+	s := startServer(t, func(w *response.Writer, req *request.Request) {
+		io.WriteString(w, "first")
+		w.Flush()
+		<-resume
+		io.WriteString(w, "second")
+	})
+	conn := dial(t, s)
+	_, err := conn.Write([]byte("GET / HTTP/1.1\r\nConnection: close\r\n\r\n"))
+	require.NoError(t, err)
+	want := "HTTP/1.1 200 OK\r\n" + testDate + "Transfer-Encoding: chunked\r\n\r\n5\r\nfirst\r\n"
+	buf := make([]byte, len(want))
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, want, normalizeDates(buf))
+
+	// Test: The rest is flushed when the handler returns
+	close(resume)
+	got, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "6\r\nsecond\r\n0\r\n\r\n", string(got))
+}
+
+func TestConnStateHook(t *testing.T) {
+	states := make(chan ConnState, 16)
+	s := startServerWithConfig(t, echoTargetHandler, Config{
+		ConnState: func(conn net.Conn, state ConnState) {
+			states <- state
+		},
+	})
+
+	conn := dial(t, s)
+	_, err := conn.Write([]byte("GET /one HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	buf := make([]byte, len(okResponse("/one:")))
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("GET /two HTTP/1.1\r\nConnection: close\r\n\r\n"))
+	require.NoError(t, err)
+	_, err = io.ReadAll(conn)
+	require.NoError(t, err)
+
+	want := []ConnState{StateNew, StateActive, StateIdle, StateActive, StateClosed}
+	for _, state := range want {
+		select {
+		case got := <-states:
+			assert.Equal(t, state, got)
+		case <-time.After(time.Second):
+			t.Fatalf("missing state %v", state)
+		}
+	}
+}
+
+func TestHandlerPanic(t *testing.T) {
+	var logs strings.Builder
+	var mu sync.Mutex
+	s := startServerWithConfig(t, func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/panic" {
+			panic("boom")
+		}
+		echoTargetHandler(w, req)
+	}, Config{ErrorLog: log.New(writerFunc(func(p []byte) (int, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return logs.Write(p)
+	}), "", 0)})
+
+	// Test: The connection is closed and the panic logged
+	conn := dial(t, s)
+	_, err := conn.Write([]byte("GET /panic HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	got, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Empty(t, got)
+	mu.Lock()
+	assert.Contains(t, logs.String(), "panic serving GET /panic: boom")
+	mu.Unlock()
+
+	// Test: The server keeps serving
+	conn = dial(t, s)
+	_, err = conn.Write([]byte("GET /fine HTTP/1.1\r\nConnection: close\r\n\r\n"))
+	require.NoError(t, err)
+	got, err = io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, okResponse("/fine:"), normalizeDates(got))
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
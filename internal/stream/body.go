@@ -0,0 +1,138 @@
+package stream
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+var (
+	ErrUnreadBody = errors.New("previous body not fully read")
+	ErrBodyClosed = errors.New("read on closed body")
+
+	// ErrBodyOverrun is returned by writes going past the declared
+	// Content-Length. Nothing of such a write is sent.
+	ErrBodyOverrun = errors.New("body longer than the declared Content-Length")
+	// ErrBodyUnderrun is returned when a body ends with fewer bytes
+	// than the declared Content-Length.
+	ErrBodyUnderrun = errors.New("body shorter than the declared Content-Length")
+)
+
+// Framing tells a Body where the message body ends. The request and
+// response parsers supply it, since they know how the message is framed.
+type Framing struct {
+	// Parse consumes the next piece of the body at the start of data. It
+	// returns the number of bytes consumed and the body bytes among them,
+	// which may alias data. n is 0 when more data is needed.
+	Parse func(data []byte) (n int, chunk []byte, err error)
+	// Done reports whether the whole body has been parsed.
+	Done func() bool
+	// EOF is called when the connection ends before the body is done. It
+	// returns nil if that ends the body, or the error to report.
+	EOF func() error
+}
+
+// Body streams a message body straight from the connection buffer.
+type Body struct {
+	buf     *Buffer
+	framing Framing
+	// pending holds decoded body bytes that didn't fit in the caller's
+	// buffer
+	pending []byte
+	err     error
+	closed  bool
+}
+
+func NewBody(buf *Buffer, framing Framing) *Body {
+	return &Body{
+		buf:     buf,
+		framing: framing,
+	}
+}
+
+func (b *Body) Read(p []byte) (int, error) {
+	if b.closed {
+		return 0, ErrBodyClosed
+	}
+	return b.read(p)
+}
+
+// Close stops further reads of the body. It doesn't skip the rest of the
+// body, Discard does that before the next message is read.
+func (b *Body) Close() error {
+	b.closed = true
+	return nil
+}
+
+// Done reports whether the whole body has been read from the connection.
+func (b *Body) Done() bool {
+	return b.framing.Done()
+}
+
+// Discard reads and throws away what is left of the body, closed or not, so
+// that the next message can be read. It gives up with ErrUnreadBody if more
+// than max bytes are left.
+func (b *Body) Discard(max int) error {
+	b.pending = nil
+
+	buf := make([]byte, 4<<10)
+	discarded := 0
+	for {
+		n, err := b.read(buf)
+		discarded += n
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if discarded > max {
+			return fmt.Errorf("%w: more than %d bytes left", ErrUnreadBody, max)
+		}
+	}
+}
+
+func (b *Body) read(p []byte) (int, error) {
+	if len(b.pending) > 0 {
+		n := copy(p, b.pending)
+		b.pending = b.pending[n:]
+		return n, nil
+	}
+	if b.err != nil {
+		return 0, b.err
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	for !b.framing.Done() {
+		n, chunk, err := b.framing.Parse(b.buf.Bytes())
+		if err != nil {
+			b.err = err
+			return 0, err
+		}
+		if n == 0 {
+			if err := b.buf.Fill(); err != nil {
+				if errors.Is(err, io.EOF) {
+					err = b.framing.EOF()
+					if err == nil {
+						break
+					}
+				}
+				b.err = err
+				return 0, err
+			}
+			continue
+		}
+
+		// chunk aliases the read buffer, which Consume overwrites
+		copied := copy(p, chunk)
+		b.pending = append(b.pending[:0], chunk[copied:]...)
+		b.buf.Consume(n)
+		if copied > 0 {
+			return copied, nil
+		}
+	}
+	b.err = io.EOF
+	return 0, io.EOF
+}
@@ -0,0 +1,77 @@
+package stream
+
+import (
+	"errors"
+	"io"
+)
+
+// Buffer holds what was read from a connection but not parsed yet. The
+// request and response readers parse messages from the front of it, so
+// bytes read past the end of one message are kept as the start of the next.
+type Buffer struct {
+	reader      io.Reader
+	buf         []byte
+	readToIndex int
+}
+
+// NewBuffer returns a Buffer reading from reader, starting with size bytes
+// of room.
+func NewBuffer(reader io.Reader, size int) *Buffer {
+	return &Buffer{
+		reader: reader,
+		buf:    make([]byte, size),
+	}
+}
+
+// Bytes returns the buffered bytes. They stay valid until the next call to
+// Fill, Grow or Consume.
+func (b *Buffer) Bytes() []byte {
+	return b.buf[:b.readToIndex]
+}
+
+// Len returns the number of buffered bytes.
+func (b *Buffer) Len() int {
+	return b.readToIndex
+}
+
+// Fill reads more data from the underlying reader, growing the buffer if it
+// is full. An io.EOF coming with data is left for the next call.
+func (b *Buffer) Fill() error {
+	if b.readToIndex >= len(b.buf) {
+		b.Grow(len(b.buf) * 2)
+	}
+	numBytesRead, err := b.reader.Read(b.buf[b.readToIndex:])
+	b.readToIndex += numBytesRead
+	if err != nil && !(numBytesRead > 0 && errors.Is(err, io.EOF)) {
+		return err
+	}
+	return nil
+}
+
+// Wait blocks until at least one byte is buffered. It returns io.EOF if the
+// reader is exhausted first.
+func (b *Buffer) Wait() error {
+	for b.readToIndex == 0 {
+		if err := b.Fill(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Grow makes room for size bytes, keeping what is buffered. It does nothing
+// if the buffer is already that large.
+func (b *Buffer) Grow(size int) {
+	if len(b.buf) >= size {
+		return
+	}
+	newBuf := make([]byte, size)
+	copy(newBuf, b.buf[:b.readToIndex])
+	b.buf = newBuf
+}
+
+// Consume drops the first n buffered bytes.
+func (b *Buffer) Consume(n int) {
+	copy(b.buf, b.buf[n:b.readToIndex])
+	b.readToIndex -= n
+}
@@ -0,0 +1,12 @@
+package stream
+
+import "time"
+
+// Deadline returns start plus timeout, or the zero time, meaning no
+// deadline, if timeout is zero.
+func Deadline(start time.Time, timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return start.Add(timeout)
+}